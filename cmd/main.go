@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"flag"
 	"net/http"
+	"os"
+	"path"
 	"time"
 
 	"github.com/shayanh/notionify"
+	"github.com/shayanh/notionify/notionclient"
 	"github.com/shayanh/notionify/recurring"
 
 	"github.com/shayanh/notionify/research"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -41,36 +46,316 @@ func newLogger() *logrus.Logger {
 	return log
 }
 
+func newExtractorChain(config notionify.IdentifiersConfig) (*research.ExtractorChain, error) {
+	ec := research.DefaultExtractorChain()
+	ec.Register(research.NewIdentifierExtractor(config.Pages), ".pdf")
+
+	var resolver research.MultiResolver
+	if config.MetadataFile != "" {
+		fr, err := research.NewFileResolver(config.MetadataFile)
+		if err != nil {
+			return nil, err
+		}
+		resolver = append(resolver, fr)
+	}
+	if config.ResolverURL != "" {
+		resolver = append(resolver, research.NewHTTPResolver(config.ResolverURL, config.ResolverTimeout))
+	}
+	if len(resolver) > 0 {
+		ec.Register(research.NewResolverExtractor(resolver))
+	}
+	return ec, nil
+}
+
+// newResearchNotionHandler returns a handler for the research database of
+// config. The process exits if the database does not match the configured
+// properties.
+func newResearchNotionHandler(config notionify.NotionConfig, props research.NotionProperties, client *http.Client, log *logrus.Logger) *research.NotionHandler {
+	schema, err := config.Schema(research.DefaultSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+	props.Schema = schema
+	nh := research.NewNotionHandler(config.Token, config.DatabaseID, props, client)
+	if err := nh.ValidateSchema(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	return nh
+}
+
+// reconcileTarget is a folder whose mapping to Notion pages is rebuilt by
+// -reconcile.
+type reconcileTarget struct {
+	rc   *research.Reconciler
+	name string
+	root string
+}
+
+// reconcile rebuilds the mappings of all targets and reports the results.
+func reconcile(targets []reconcileTarget, dryRun bool, log *logrus.Logger) error {
+	ctx := context.Background()
+	for _, target := range targets {
+		report, err := target.rc.Reconcile(ctx, target.root, dryRun)
+		if err != nil {
+			return err
+		}
+		log.WithFields(logrus.Fields{
+			"Synchronizer": target.name,
+			"Matches":      len(report.Matches),
+			"Conflicts":    len(report.Conflicts),
+			"Unmatched":    len(report.Unmatched),
+			"Orphans":      len(report.Orphans),
+			"Stale":        len(report.Stale),
+			"DryRun":       dryRun,
+		}).Info("Reconciliation finished.")
+	}
+	return nil
+}
+
+// newStateStore returns the configured state store. The redis client is nil
+// unless the state is kept in redis.
+func newStateStore(config notionify.StateConfig, redisConfig notionify.RedisConfig) (research.StateStore, *redis.Client, error) {
+	switch config.Type {
+	case "", "redis":
+		rdb := redis.NewClient(&redis.Options{
+			Addr:     redisConfig.Addr,
+			Password: redisConfig.Password,
+			DB:       redisConfig.DB,
+		})
+		return research.NewRedisStateStore(rdb), rdb, nil
+	case "bolt":
+		if config.Path == "" {
+			return nil, nil, errors.New("bolt state store needs a path")
+		}
+		bs, err := research.NewBoltStateStore(config.Path)
+		return bs, nil, err
+	case "memory":
+		return research.NewMemoryStateStore(), nil, nil
+	default:
+		return nil, nil, errors.Errorf("unknown state store %q", config.Type)
+	}
+}
+
 func main() {
 	// logrus.SetLevel(logrus.DebugLevel)
 	logrus.SetFormatter(newFormatter())
 	log := newLogger()
 
+	reconcileOnly := flag.Bool("reconcile", false, "rebuild the mapping between files and Notion pages and exit")
+	dryRun := flag.Bool("dry-run", false, "report the results of -reconcile without writing them")
+	flag.Parse()
+
 	rootConfig, err := notionify.ReadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     rootConfig.Redis.Addr,
-		Password: rootConfig.Redis.Password,
-		DB:       rootConfig.Redis.DB,
-	})
+	ss, rdb, err := newStateStore(rootConfig.State, rootConfig.Redis)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	router := mux.NewRouter()
 	router.StrictSlash(true)
 
+	// Notion limits the requests of all handlers together.
+	nt := notionclient.NewTransport(rootConfig.Notion.RequestsPerSecond, rootConfig.Notion.Burst,
+		rootConfig.Notion.MaxRetries, log)
+	notionClient := nt.Client()
+	if rootConfig.Research.AdminToken != "" {
+		sh := notionclient.NewStatsHandler(rootConfig.Research.AdminToken, nt)
+		sh.HandleFuncs(router.PathPrefix("/admin/notion-stats").Subrouter())
+	}
+
 	func(config notionify.ResearchConfig) {
-		nh := research.NewNotionHandler(config.Notion.Token, config.Notion.DatabaseID)
-		ch := research.NewCloudFileSyncerImpl(nh, rdb, log)
-		dh := research.NewDropboxHandler(config.Dropbox.Token, log)
-		ds := research.NewDropboxSynchronizer(dh, ch, rdb, log)
-		dwh := research.NewDropboxWebhookHandler(config.Dropbox.RootFolder, ds, log)
+		opts := research.SyncOptions{
+			DeletePolicy:    research.DeletePolicy(config.DeletePolicy),
+			UpdateTitles:    config.UpdateTitles,
+			DuplicatePolicy: research.DuplicatePolicy(config.DuplicatePolicy),
+		}
+		if err := opts.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		if opts.DuplicatePolicy == research.DuplicatePolicyAlternate && config.AlternatesProperty == "" {
+			log.Fatal("the alternate duplicate policy needs an alternates property")
+		}
+		props := research.NotionProperties{
+			Folder: config.FolderProperty,
+			Folders: research.FolderMapping{
+				Property:   config.Folders.Property,
+				Type:       research.FolderPropertyType(config.Folders.Type),
+				Values:     config.Folders.Values,
+				OnlyMapped: config.Folders.OnlyMapped,
+			},
+			Alternates: config.AlternatesProperty,
+			Authors:    config.Metadata.Authors,
+			Year:       config.Metadata.Year,
+			DOI:        config.Metadata.DOI,
+			ArXivID:    config.Metadata.ArXivID,
+			Venue:      config.Metadata.Venue,
+			Abstract:   config.Metadata.Abstract,
+			Keywords:   config.Metadata.Keywords,
+			PageCount:  config.Metadata.PageCount,
+		}
+		if err := props.Folders.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		recursive := config.Recursive || props.Folders.Enabled()
+		ec, err := newExtractorChain(config.Identifiers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		links := research.DropboxLinkOptions{
+			PreviewOnly: config.Dropbox.Links.PreviewOnly,
+			Visibility:  config.Dropbox.Links.Visibility,
+			Password:    config.Dropbox.Links.Password,
+			Expiry:      config.Dropbox.Links.Expiry,
+		}
+		if err := links.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		sq := research.NewSyncQueue(rdb, config.Queue.Workers, config.Queue.VisibilityTimeout, log)
+		var synchronizers []*research.FolderSynchronizer
+		var targets []reconcileTarget
+		var archivers []*research.NotionSyncerImpl
+		rules := research.ArchiveRules{
+			Types:     config.Archive.Types,
+			Tags:      config.Archive.Tags,
+			SkipHosts: config.Archive.SkipHosts,
+		}
+		if rules.Types == nil {
+			rules.Types = research.DefaultArchiveRules.Types
+		}
+		if rules.SkipHosts == nil {
+			rules.SkipHosts = research.DefaultArchiveRules.SkipHosts
+		}
+		var accounts []*research.DropboxAccount
+		for _, account := range config.DropboxAccounts() {
+			nh := newResearchNotionHandler(account.Notion, props, notionClient, log)
+			ch := research.NewCloudFileSyncerImpl(nh, ss, log, opts)
+			dh := research.NewDropboxHandler(account.Token, links, log)
+			cb := research.NewCloudFileBuilder(dh, account.AccountID, ec, config.MaxExtractSize, config.ExtractWorkers, log)
+			fs := research.NewFolderSynchronizer(recursive, config.SyncWorkers, cb, ch, ss, log)
+			synchronizers = append(synchronizers, fs)
+			targets = append(targets, reconcileTarget{research.NewReconciler(fs, nh, log), fs.Name(), account.RootFolder})
+			sq.Register(fs)
+			accounts = append(accounts, research.NewDropboxAccount(account.AccountID, account.RootFolder, fs))
+			if config.Archive.Folder != "" {
+				folder := path.Join("/", account.RootFolder, config.Archive.Folder)
+				archivers = append(archivers, research.NewNotionSyncerImpl(folder, rules, nh, cb, ss, log))
+			}
+		}
+		dwh := research.NewDropboxWebhookHandler(config.Dropbox.AppSecret, accounts, sq, log)
 		dwh.HandleFuncs(router.PathPrefix("/dropbox-webhook").Subrouter())
+
+		if config.Local.Root != "" {
+			nh := newResearchNotionHandler(config.Notion, props, notionClient, log)
+			ch := research.NewCloudFileSyncerImpl(nh, ss, log, opts)
+			lp := research.NewLocalProvider(config.Local.Root, config.Local.URLTemplate)
+			cb := research.NewCloudFileBuilder(lp, "", ec, config.MaxExtractSize, config.ExtractWorkers, log)
+			fs := research.NewFolderSynchronizer(recursive, config.SyncWorkers, cb, ch, ss, log)
+			synchronizers = append(synchronizers, fs)
+			targets = append(targets, reconcileTarget{research.NewReconciler(fs, nh, log), fs.Name(), "/"})
+			sq.Register(fs)
+			if !*reconcileOnly {
+				lw := research.NewLocalWatcher(lp, fs, "/", config.Local.Debounce, log)
+				go func() {
+					if err := lw.Run(context.Background()); err != nil {
+						log.Error(err)
+					}
+				}()
+			}
+		}
+
+		if config.S3.Endpoint != "" {
+			nh := newResearchNotionHandler(config.Notion, props, notionClient, log)
+			ch := research.NewCloudFileSyncerImpl(nh, ss, log, opts)
+			sp, err := research.NewS3Provider(research.S3Options{
+				Endpoint:      config.S3.Endpoint,
+				Region:        config.S3.Region,
+				Bucket:        config.S3.Bucket,
+				AccessKey:     config.S3.AccessKey,
+				SecretKey:     config.S3.SecretKey,
+				PublicURL:     config.S3.PublicURL,
+				PresignExpiry: config.S3.PresignExpiry,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			cb := research.NewCloudFileBuilder(sp, config.S3.Bucket, ec, config.MaxExtractSize, config.ExtractWorkers, log)
+			fs := research.NewFolderSynchronizer(recursive, config.SyncWorkers, cb, ch, ss, log)
+			synchronizers = append(synchronizers, fs)
+			targets = append(targets, reconcileTarget{research.NewReconciler(fs, nh, log), fs.Name(), config.S3.RootFolder})
+			sq.Register(fs)
+			if interval := sp.LinkRefreshInterval(); interval > 0 && !*reconcileOnly {
+				// Bucket notifications do not cover expiring links.
+				go research.PollFolder(context.Background(), fs, config.S3.RootFolder, interval)
+			}
+			seh := research.NewS3EventHandler(config.S3.Bucket, config.S3.RootFolder, config.S3.EventToken, fs, sq, log)
+			seh.HandleFuncs(router.PathPrefix("/s3-events").Subrouter())
+		}
+
+		if config.WebDAV.URL != "" {
+			nh := newResearchNotionHandler(config.Notion, props, notionClient, log)
+			ch := research.NewCloudFileSyncerImpl(nh, ss, log, opts)
+			wp, err := research.NewWebDAVProvider(research.WebDAVOptions{
+				URL:      config.WebDAV.URL,
+				Username: config.WebDAV.Username,
+				Password: config.WebDAV.Password,
+				ShareURL: config.WebDAV.ShareURL,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			cb := research.NewCloudFileBuilder(wp, "", ec, config.MaxExtractSize, config.ExtractWorkers, log)
+			fs := research.NewFolderSynchronizer(recursive, config.SyncWorkers, cb, ch, ss, log)
+			synchronizers = append(synchronizers, fs)
+			targets = append(targets, reconcileTarget{research.NewReconciler(fs, nh, log), fs.Name(), config.WebDAV.RootFolder})
+			sq.Register(fs)
+			if !*reconcileOnly {
+				go research.PollFolder(context.Background(), fs, config.WebDAV.RootFolder, config.WebDAV.Interval)
+			}
+		}
+
+		if *reconcileOnly {
+			if err := reconcile(targets, *dryRun, log); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}
+
+		if config.Archive.Token != "" && len(archivers) > 0 {
+			ah := research.NewArchiveHandler(config.Archive.Token, archivers, log)
+			ah.HandleFuncs(router.PathPrefix("/notion-archive").Subrouter())
+			go ah.Run(context.Background())
+		}
+		if config.Archive.Interval > 0 {
+			for _, ns := range archivers {
+				go ns.Run(context.Background(), config.Archive.Interval)
+			}
+		}
+
+		if config.AdminToken != "" {
+			dlh := research.NewDeadLetterHandler(config.AdminToken, synchronizers, log)
+			dlh.HandleFuncs(router.PathPrefix("/admin/dead-letters").Subrouter())
+		}
+
+		go func() {
+			if err := sq.Run(context.Background()); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}(rootConfig.Research)
 
 	go func(config notionify.RecurringConfig) {
-		nh := recurring.NewNotionHandler(config.Notion.Token, config.Notion.DatabaseID)
+		schema, err := config.Notion.Schema(recurring.DefaultSchema)
+		if err != nil {
+			log.Fatal(err)
+		}
+		nh := recurring.NewNotionHandler(config.Notion.Token, config.Notion.DatabaseID, schema, notionClient)
+		if err := nh.ValidateSchema(context.Background()); err != nil {
+			log.Fatal(err)
+		}
 		th := recurring.NewTasksHandler(nh, log)
 		ctx := context.Background()
 		for {
@@ -3,6 +3,8 @@ package notionify
 import (
 	"time"
 
+	"github.com/jomei/notionapi"
+	"github.com/shayanh/notionify/notionclient"
 	"github.com/spf13/viper"
 )
 
@@ -11,11 +13,178 @@ type RootConfig struct {
 	Redis     RedisConfig     `mapstructure:"redis"`
 	Research  ResearchConfig  `mapstructure:"research"`
 	Recurring RecurringConfig `mapstructure:"recurring"`
+	// Notion configures the client shared by all Notion API calls.
+	Notion NotionClientConfig `mapstructure:"notion"`
+	// State selects where the synchronization state is kept.
+	State StateConfig `mapstructure:"state"`
+}
+
+// NotionClientConfig configures the rate limiting and retries of Notion API
+// requests.
+type NotionClientConfig struct {
+	// RequestsPerSecond is the average request rate. Defaults to 3.
+	RequestsPerSecond float64 `mapstructure:"requestsPerSecond"`
+	// Burst is the number of requests that may be sent at once. Defaults
+	// to 3.
+	Burst int `mapstructure:"burst"`
+	// MaxRetries is how often a throttled or failed request is retried.
+	// Defaults to 5.
+	MaxRetries int `mapstructure:"maxRetries"`
 }
 
 type ResearchConfig struct {
 	Dropbox DropboxConfig `mapstructure:"dropbox"`
+	Local   LocalConfig   `mapstructure:"local"`
+	S3      S3Config      `mapstructure:"s3"`
+	WebDAV  WebDAVConfig  `mapstructure:"webdav"`
 	Notion  NotionConfig  `mapstructure:"notion"`
+	// DeletePolicy is one of "archive", "tag" or "clear-url". Notion pages of
+	// deleted files are left untouched when it is empty.
+	DeletePolicy string `mapstructure:"deletePolicy"`
+	// UpdateTitles updates the Name of a page when its file is renamed,
+	// unless the Name has been edited in Notion.
+	UpdateTitles bool `mapstructure:"updateTitles"`
+	// DuplicatePolicy is one of "link", "alternate" or "tag". It applies to
+	// new files with the content of an already synchronized file, which
+	// Dropbox recognizes by their content hash. Every file gets its own page
+	// when it is empty.
+	DuplicatePolicy string `mapstructure:"duplicatePolicy"`
+	// AlternatesProperty is the name of a text property that the "alternate"
+	// duplicate policy lists the locations of duplicates in.
+	AlternatesProperty string `mapstructure:"alternatesProperty"`
+	// FolderProperty is the name of a text property that holds the folder of
+	// the file. It is not written when empty.
+	FolderProperty string `mapstructure:"folderProperty"`
+	// Recursive synchronizes the files in subfolders of the root folder.
+	Recursive bool `mapstructure:"recursive"`
+	// Folders maps subfolders of the root folder to a Notion property.
+	// Setting it implies Recursive.
+	Folders FolderMappingConfig `mapstructure:"folders"`
+	// Metadata names the Notion properties that extracted metadata is
+	// written to.
+	Metadata MetadataPropertiesConfig `mapstructure:"metadata"`
+	// Identifiers configures the lookup of DOIs and arXiv identifiers.
+	Identifiers IdentifiersConfig `mapstructure:"identifiers"`
+	// MaxExtractSize is the size in bytes above which files are not
+	// downloaded for metadata extraction, and are named after their file
+	// name. Zero means no limit.
+	MaxExtractSize int64 `mapstructure:"maxExtractSize"`
+	// ExtractWorkers is the number of files downloaded concurrently for
+	// metadata extraction. Defaults to 4.
+	ExtractWorkers int `mapstructure:"extractWorkers"`
+	// SyncWorkers is the number of files synchronized with Notion
+	// concurrently. Defaults to 3.
+	SyncWorkers int `mapstructure:"syncWorkers"`
+	// AdminToken is the bearer token of the endpoints below /admin, which
+	// manage dead-lettered files. They are disabled when it is empty.
+	AdminToken string `mapstructure:"adminToken"`
+	// Queue configures the processing of synchronizations requested by
+	// webhooks.
+	Queue QueueConfig `mapstructure:"queue"`
+	// Archive configures the archiving of the files that pages link to.
+	Archive ArchiveConfig `mapstructure:"archive"`
+}
+
+// ArchiveConfig configures the archiving of the files that pages link to,
+// e.g. papers on arXiv, to the Dropbox account of their database. The URL of
+// an archived page is replaced with the link of its file.
+type ArchiveConfig struct {
+	// Folder is the folder below the root folder of each Dropbox account
+	// that files are archived to. Archiving is disabled when it is empty.
+	Folder string `mapstructure:"folder"`
+	// Interval is how often the databases are checked. They are only checked
+	// on requests to /notion-archive when it is zero.
+	Interval time.Duration `mapstructure:"interval"`
+	// Token is the bearer token of requests to /notion-archive, e.g. from a
+	// Notion automation. The endpoint is disabled when it is empty.
+	Token string `mapstructure:"token"`
+	// Types are the page types that are archived. Defaults to paper.
+	Types []string `mapstructure:"types"`
+	// Tags restricts archiving to pages with one of the tags.
+	Tags []string `mapstructure:"tags"`
+	// SkipHosts are hosts whose links are not archived. Defaults to the
+	// Dropbox hosts.
+	SkipHosts []string `mapstructure:"skipHosts"`
+}
+
+// QueueConfig configures the queue of synchronization jobs.
+type QueueConfig struct {
+	// Workers is the number of jobs processed concurrently. Defaults to 2.
+	Workers int `mapstructure:"workers"`
+	// VisibilityTimeout is how long a job may run before it is handed to
+	// another worker. Defaults to 10 minutes.
+	VisibilityTimeout time.Duration `mapstructure:"visibilityTimeout"`
+}
+
+type IdentifiersConfig struct {
+	// Pages is the number of leading PDF pages scanned for identifiers.
+	Pages int `mapstructure:"pages"`
+	// MetadataFile is a BibTeX (.bib) or JSON file that identifiers are
+	// resolved from before ResolverURL is asked.
+	MetadataFile string `mapstructure:"metadataFile"`
+	// ResolverURL is a DOI content negotiation endpoint, e.g.
+	// https://doi.org. Online resolution is disabled when it is empty.
+	ResolverURL string `mapstructure:"resolverURL"`
+	// ResolverTimeout bounds each request to ResolverURL. It defaults to 10
+	// seconds.
+	ResolverTimeout time.Duration `mapstructure:"resolverTimeout"`
+}
+
+// MetadataPropertiesConfig names the Notion properties of extracted metadata.
+// Fields without a property are not written.
+type MetadataPropertiesConfig struct {
+	Authors   string `mapstructure:"authors"`
+	Year      string `mapstructure:"year"`
+	DOI       string `mapstructure:"doi"`
+	ArXivID   string `mapstructure:"arxiv"`
+	Venue     string `mapstructure:"venue"`
+	Abstract  string `mapstructure:"abstract"`
+	Keywords  string `mapstructure:"keywords"`
+	PageCount string `mapstructure:"pageCount"`
+}
+
+// FolderMappingConfig maps the subfolders of the root folder, e.g. ML and
+// Transformers in /Papers/ML/Transformers, to a Notion property.
+type FolderMappingConfig struct {
+	// Property is the name of the Notion property, e.g. Tags.
+	Property string `mapstructure:"property"`
+	// Type is either "multi_select" or "select".
+	Type string `mapstructure:"type"`
+	// Values maps folder names to option names. Keys are case-insensitive.
+	Values map[string]string `mapstructure:"values"`
+	// OnlyMapped ignores folders that are not in Values. Otherwise they are
+	// mapped to their own name.
+	OnlyMapped bool `mapstructure:"onlyMapped"`
+}
+
+// DropboxAccounts returns the configured Dropbox accounts. Missing Notion
+// settings are inherited from the research config. If no accounts are
+// configured, a single account without an ID is built from the top-level
+// Dropbox settings.
+func (c ResearchConfig) DropboxAccounts() []DropboxAccountConfig {
+	if len(c.Dropbox.Accounts) == 0 {
+		return []DropboxAccountConfig{
+			{
+				Token:      c.Dropbox.Token,
+				RootFolder: c.Dropbox.RootFolder,
+				Notion:     c.Notion,
+			},
+		}
+	}
+	var accounts []DropboxAccountConfig
+	for _, account := range c.Dropbox.Accounts {
+		if account.Notion.Token == "" {
+			account.Notion.Token = c.Notion.Token
+		}
+		if account.Notion.DatabaseID == "" {
+			account.Notion.DatabaseID = c.Notion.DatabaseID
+			if account.Notion.Properties == nil {
+				account.Notion.Properties = c.Notion.Properties
+			}
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
 }
 
 type RecurringConfig struct {
@@ -30,11 +199,126 @@ type WebConfig struct {
 type DropboxConfig struct {
 	Token      string `mapstructure:"token"`
 	RootFolder string `mapstructure:"rootFolder"`
+	AppSecret  string `mapstructure:"appSecret"`
+	// Links configures the shared links of files in all accounts.
+	Links DropboxLinksConfig `mapstructure:"links"`
+
+	Accounts []DropboxAccountConfig `mapstructure:"accounts"`
+}
+
+// DropboxLinksConfig configures the shared links that files are linked to.
+// Files without a shared link get one.
+type DropboxLinksConfig struct {
+	// PreviewOnly links files to their preview URL, which only works for
+	// files that were shared before. No links are created.
+	PreviewOnly bool `mapstructure:"previewOnly"`
+	// Visibility is one of "public", "team_only" and "password".
+	Visibility string `mapstructure:"visibility"`
+	Password   string `mapstructure:"password"`
+	// Expiry is how long created links are valid. They do not expire when it
+	// is zero.
+	Expiry time.Duration `mapstructure:"expiry"`
+}
+
+// LocalConfig configures the synchronization of a local directory.
+type LocalConfig struct {
+	// Root is the directory to synchronize. It is not synchronized when
+	// empty.
+	Root string `mapstructure:"root"`
+	// URLTemplate builds the URL of a file. {path} is replaced with the path
+	// of the file relative to Root, and {id} with its ID.
+	URLTemplate string `mapstructure:"urlTemplate"`
+	// Debounce is how long the directory has to be quiet before it is
+	// synchronized.
+	Debounce time.Duration `mapstructure:"debounce"`
+}
+
+// S3Config configures the synchronization of a bucket of an S3-compatible
+// object storage such as MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. http://localhost:9000.
+	// The bucket is not synchronized when it is empty.
+	Endpoint  string `mapstructure:"endpoint"`
+	Region    string `mapstructure:"region"`
+	Bucket    string `mapstructure:"bucket"`
+	AccessKey string `mapstructure:"accessKey"`
+	SecretKey string `mapstructure:"secretKey"`
+	// RootFolder is the key prefix to synchronize.
+	RootFolder string `mapstructure:"rootFolder"`
+	// PublicURL builds the URL of an object by replacing {bucket} and {key}.
+	// Presigned URLs valid for PresignExpiry are used when it is empty. The
+	// bucket is then polled so that pages get a new URL before it expires.
+	PublicURL     string        `mapstructure:"publicURL"`
+	PresignExpiry time.Duration `mapstructure:"presignExpiry"`
+	// EventToken is the bearer token that bucket notifications sent to
+	// /s3-events have to carry.
+	EventToken string `mapstructure:"eventToken"`
+}
+
+// WebDAVConfig configures the synchronization of a folder on a WebDAV server
+// such as Nextcloud.
+type WebDAVConfig struct {
+	// URL is the WebDAV root, e.g.
+	// https://cloud.example.com/remote.php/dav/files/alice. The folder is not
+	// synchronized when it is empty.
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// ShareURL is the Nextcloud server URL used to create public share links.
+	// Files link to their WebDAV URL when it is empty.
+	ShareURL   string `mapstructure:"shareURL"`
+	RootFolder string `mapstructure:"rootFolder"`
+	// Interval is how often the folder is checked for changes.
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// DropboxAccountConfig binds a Dropbox account to its own token, root folder
+// and Notion database.
+type DropboxAccountConfig struct {
+	AccountID  string       `mapstructure:"accountID"`
+	Token      string       `mapstructure:"token"`
+	RootFolder string       `mapstructure:"rootFolder"`
+	Notion     NotionConfig `mapstructure:"notion"`
 }
 
 type NotionConfig struct {
 	Token      string `mapstructure:"token"`
 	DatabaseID string `mapstructure:"databaseID"`
+	// Properties maps logical fields, e.g. name, tags or duedate, to the
+	// properties of the database. Fields that are not set keep their default
+	// property.
+	Properties map[string]NotionPropertyConfig `mapstructure:"properties"`
+}
+
+// NotionPropertyConfig names a database property. Type, e.g. multi_select,
+// can only be the default type of the field, as the field is read and
+// written as that type. Empty values keep the default.
+type NotionPropertyConfig struct {
+	Name string `mapstructure:"name"`
+	Type string `mapstructure:"type"`
+}
+
+// Schema returns defaults with the configured properties.
+func (c NotionConfig) Schema(defaults notionclient.Schema) (notionclient.Schema, error) {
+	overrides := make(map[string]notionclient.Property)
+	for field, prop := range c.Properties {
+		overrides[field] = notionclient.Property{
+			Name: prop.Name,
+			Type: notionapi.PropertyType(prop.Type),
+		}
+	}
+	return defaults.Override(overrides)
+}
+
+// StateConfig configures the store of cursors, file to page mappings, dead
+// letters and locks.
+type StateConfig struct {
+	// Type is one of "redis", "bolt" and "memory". Defaults to "redis".
+	// Webhook jobs are only queued durably with redis, and the memory store
+	// loses all state when the process exits.
+	Type string `mapstructure:"type"`
+	// Path is the database file of the bolt store.
+	Path string `mapstructure:"path"`
 }
 
 type RedisConfig struct {
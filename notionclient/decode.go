@@ -0,0 +1,161 @@
+package notionclient
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jomei/notionapi"
+	"go.uber.org/multierr"
+)
+
+// PropertyError is a property of a page that does not have the expected
+// type.
+type PropertyError struct {
+	PageID   string
+	Property string
+	Expected notionapi.PropertyType
+	Actual   notionapi.PropertyType
+}
+
+func (e *PropertyError) Error() string {
+	return fmt.Sprintf("page %s: property %q has type %s, expected %s", e.PageID, e.Property, e.Actual, e.Expected)
+}
+
+// MalformedPagesError lists the pages of a listing that could not be decoded
+// and were left out.
+type MalformedPagesError struct {
+	Errs []error
+}
+
+func (e *MalformedPagesError) Error() string {
+	var msgs []string
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d malformed pages skipped: %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// IsMalformed reports whether err only reports skipped pages, so that the
+// other results can be used.
+func IsMalformed(err error) bool {
+	_, ok := err.(*MalformedPagesError)
+	return ok
+}
+
+// Decoder reads typed values from the properties of a page. Missing
+// properties and properties without a name read as zero values. Properties
+// of an unexpected type read as zero values too, and are reported by Err.
+type Decoder struct {
+	page *notionapi.Page
+	errs error
+}
+
+func NewDecoder(page *notionapi.Page) *Decoder {
+	return &Decoder{page: page}
+}
+
+// Err returns the PropertyErrors of the decoded properties.
+func (d *Decoder) Err() error {
+	return d.errs
+}
+
+func (d *Decoder) property(name string) notionapi.Property {
+	if name == "" {
+		return nil
+	}
+	return d.page.Properties[name]
+}
+
+func (d *Decoder) mismatch(name string, expected notionapi.PropertyType, prop notionapi.Property) {
+	d.errs = multierr.Append(d.errs, &PropertyError{
+		PageID:   string(d.page.ID),
+		Property: name,
+		Expected: expected,
+		Actual:   prop.GetType(),
+	})
+}
+
+func plainText(texts []notionapi.RichText) string {
+	var b strings.Builder
+	for _, text := range texts {
+		b.WriteString(text.PlainText)
+	}
+	return b.String()
+}
+
+// Title returns the plain text of a title property.
+func (d *Decoder) Title(name string) string {
+	switch prop := d.property(name).(type) {
+	case nil:
+	case *notionapi.PageTitleProperty:
+		return plainText(prop.Title)
+	default:
+		d.mismatch(name, notionapi.PropertyTypeTitle, prop)
+	}
+	return ""
+}
+
+// RichText returns the plain text of a text property.
+func (d *Decoder) RichText(name string) string {
+	switch prop := d.property(name).(type) {
+	case nil:
+	case *notionapi.RichTextProperty:
+		return plainText(prop.RichText)
+	default:
+		d.mismatch(name, notionapi.PropertyTypeRichText, prop)
+	}
+	return ""
+}
+
+// Select returns the selected option of a select property.
+func (d *Decoder) Select(name string) string {
+	switch prop := d.property(name).(type) {
+	case nil:
+	case *notionapi.SelectOptionProperty:
+		return prop.Select.Name
+	default:
+		d.mismatch(name, notionapi.PropertyTypeSelect, prop)
+	}
+	return ""
+}
+
+// MultiSelect returns the selected options of a multi-select property.
+func (d *Decoder) MultiSelect(name string) []string {
+	switch prop := d.property(name).(type) {
+	case nil:
+	case *notionapi.MultiSelectOptionsProperty:
+		var names []string
+		for _, option := range prop.MultiSelect {
+			names = append(names, option.Name)
+		}
+		return names
+	default:
+		d.mismatch(name, notionapi.PropertyTypeMultiSelect, prop)
+	}
+	return nil
+}
+
+// URL returns the value of a URL property, or "" if it is empty.
+func (d *Decoder) URL(name string) string {
+	switch prop := d.property(name).(type) {
+	case nil:
+	case *notionapi.URLProperty:
+		url, _ := prop.URL.(string)
+		return url
+	default:
+		d.mismatch(name, notionapi.PropertyTypeURL, prop)
+	}
+	return ""
+}
+
+// Date returns the start of a date property.
+func (d *Decoder) Date(name string) string {
+	switch prop := d.property(name).(type) {
+	case nil:
+	case *notionapi.DateProperty:
+		return prop.Date.Start
+	default:
+		d.mismatch(name, notionapi.PropertyTypeDate, prop)
+	}
+	return ""
+}
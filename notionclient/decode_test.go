@@ -0,0 +1,173 @@
+package notionclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jomei/notionapi"
+	"github.com/shayanh/notionify/notionclient"
+	"github.com/shayanh/notionify/recurring"
+	"github.com/shayanh/notionify/research"
+	"go.uber.org/multierr"
+)
+
+const validPage = `{
+	"object": "page",
+	"id": "page-valid",
+	"properties": {
+		"Name": {"id": "title", "type": "title", "title": [{"type": "text", "text": {"content": "Attention"}, "plain_text": "Attention"}]},
+		"URL": {"id": "url", "type": "url", "url": "https://arxiv.org/abs/1706.03762"},
+		"Tags": {"id": "tags", "type": "multi_select", "multi_select": [{"name": "recurring"}]},
+		"Status": {"id": "status", "type": "select", "select": {"name": "Done"}}
+	}
+}`
+
+const emptyURLPage = `{
+	"object": "page",
+	"id": "page-empty-url",
+	"properties": {
+		"Name": {"id": "title", "type": "title", "title": [{"type": "text", "text": {"content": "Attention"}, "plain_text": "Attention"}]},
+		"URL": {"id": "url", "type": "url", "url": null}
+	}
+}`
+
+const richTextNamePage = `{
+	"object": "page",
+	"id": "page-rich-text",
+	"properties": {
+		"Name": {"id": "title", "type": "rich_text", "rich_text": [{"type": "text", "text": {"content": "Attention"}, "plain_text": "Attention"}]},
+		"URL": {"id": "url", "type": "url", "url": "https://arxiv.org/abs/1706.03762"}
+	}
+}`
+
+const missingURLPage = `{
+	"object": "page",
+	"id": "page-missing-url",
+	"properties": {
+		"Name": {"id": "title", "type": "title", "title": [{"type": "text", "text": {"content": "Attention"}, "plain_text": "Attention"}]}
+	}
+}`
+
+func decodePage(t *testing.T, fixture string) *notionapi.Page {
+	t.Helper()
+	var page notionapi.Page
+	if err := json.Unmarshal([]byte(fixture), &page); err != nil {
+		t.Fatalf("decoding fixture: %v", err)
+	}
+	return &page
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		title   string
+		url     string
+		errs    []notionclient.PropertyError
+	}{
+		{"valid", validPage, "Attention", "https://arxiv.org/abs/1706.03762", nil},
+		{"empty url", emptyURLPage, "Attention", "", nil},
+		{"missing property", missingURLPage, "Attention", "", nil},
+		{"title changed to rich text", richTextNamePage, "", "https://arxiv.org/abs/1706.03762", []notionclient.PropertyError{
+			{
+				PageID:   "page-rich-text",
+				Property: "Name",
+				Expected: notionapi.PropertyTypeTitle,
+				Actual:   notionapi.PropertyTypeRichText,
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := notionclient.NewDecoder(decodePage(t, tt.fixture))
+			if title := d.Title("Name"); title != tt.title {
+				t.Errorf("Title = %q, want %q", title, tt.title)
+			}
+			if url := d.URL("URL"); url != tt.url {
+				t.Errorf("URL = %q, want %q", url, tt.url)
+			}
+			if tags := d.MultiSelect(""); tags != nil {
+				t.Errorf("MultiSelect of an unnamed property = %v, want nil", tags)
+			}
+
+			errs := multierr.Errors(d.Err())
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("Err = %v, want %d errors", d.Err(), len(tt.errs))
+			}
+			for i, err := range errs {
+				propErr, ok := err.(*notionclient.PropertyError)
+				if !ok {
+					t.Fatalf("error %d = %T, want *PropertyError", i, err)
+				}
+				if *propErr != tt.errs[i] {
+					t.Errorf("error %d = %+v, want %+v", i, *propErr, tt.errs[i])
+				}
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// queryClient returns a client that answers every request with a database
+// query response listing pages.
+func queryClient(pages ...string) *http.Client {
+	body := `{"object": "list", "results": [` + strings.Join(pages, ",") + `], "has_more": false}`
+	return &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+				Request:    req,
+			}, nil
+		}),
+	}
+}
+
+func checkMalformed(t *testing.T, err error, pageID string) {
+	t.Helper()
+	if !notionclient.IsMalformed(err) {
+		t.Fatalf("err = %v, want a MalformedPagesError", err)
+	}
+	errs := err.(*notionclient.MalformedPagesError).Errs
+	if len(errs) != 1 {
+		t.Fatalf("Errs = %v, want one error", errs)
+	}
+	propErr, ok := errs[0].(*notionclient.PropertyError)
+	if !ok || propErr.PageID != pageID {
+		t.Errorf("Errs[0] = %v, want a PropertyError of %s", errs[0], pageID)
+	}
+}
+
+func TestListPagesSkipsMalformedPages(t *testing.T) {
+	nh := research.NewNotionHandler("token", "database", research.NotionProperties{}, queryClient(validPage, richTextNamePage, emptyURLPage))
+	pages, err := nh.ListPages(context.Background())
+	checkMalformed(t, err, "page-rich-text")
+
+	var ids []string
+	for _, page := range pages {
+		ids = append(ids, page.ID)
+	}
+	if got := strings.Join(ids, ","); got != "page-valid,page-empty-url" {
+		t.Errorf("pages = %s, want page-valid,page-empty-url", got)
+	}
+}
+
+func TestListTasksSkipsMalformedPages(t *testing.T) {
+	nh := recurring.NewNotionHandler("token", "database", nil, queryClient(richTextNamePage, validPage))
+	tasks, err := nh.ListTasks(context.Background())
+	checkMalformed(t, err, "page-rich-text")
+
+	if len(tasks) != 1 || tasks[0].ID != "page-valid" || tasks[0].Status != "Done" {
+		t.Errorf("tasks = %+v, want page-valid", tasks)
+	}
+}
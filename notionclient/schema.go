@@ -0,0 +1,141 @@
+package notionclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jomei/notionapi"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+const (
+	notionDatabasesURL = "https://api.notion.com/v1/databases/"
+	notionVersion      = "2021-05-13"
+)
+
+// Property is the Notion property that a logical field is stored in.
+type Property struct {
+	Name string
+	Type notionapi.PropertyType
+	// Optional fields are disabled when the database has no property of
+	// their name.
+	Optional bool
+}
+
+// Schema maps the logical fields of a database to its properties. Field
+// names are lower case.
+type Schema map[string]Property
+
+// Name returns the name of the property of field, or "" if the field is
+// disabled.
+func (s Schema) Name(field string) string {
+	return s[strings.ToLower(field)].Name
+}
+
+// Override returns a copy of s with the names set in overrides. Overriding
+// unknown fields is an error, and so is overriding a type, since fields are
+// read and written as their default type. A type equal to the default is
+// accepted.
+func (s Schema) Override(overrides map[string]Property) (Schema, error) {
+	res := make(Schema, len(s))
+	for field, prop := range s {
+		res[field] = prop
+	}
+	for field, override := range overrides {
+		field = strings.ToLower(field)
+		prop, ok := res[field]
+		if !ok {
+			return nil, errors.Errorf("unknown property field %q", field)
+		}
+		if override.Name != "" {
+			prop.Name = override.Name
+		}
+		if override.Type != "" && override.Type != prop.Type {
+			return nil, errors.Errorf("field %s: type %s is not supported, the property has to be a %s", field, override.Type, prop.Type)
+		}
+		res[field] = prop
+	}
+	return res, nil
+}
+
+// fields returns the fields of s in a stable order.
+func (s Schema) fields() []string {
+	var fields []string
+	for field := range s {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// FetchSchema returns the types of the properties of the database by name.
+// The database is requested directly as notionapi cannot decode every
+// property configuration.
+func FetchSchema(ctx context.Context, client *http.Client, token string, databaseID string) (map[string]notionapi.PropertyType, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, notionDatabasesURL+databaseID, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "FetchSchema failed")
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Notion-Version", notionVersion)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "FetchSchema failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr notionapi.Error
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			return nil, errors.Wrapf(err, "FetchSchema failed with status %d", resp.StatusCode)
+		}
+		return nil, errors.Wrap(&apiErr, "FetchSchema failed")
+	}
+
+	var db struct {
+		Properties map[string]struct {
+			Type notionapi.PropertyType `json:"type"`
+		} `json:"properties"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&db); err != nil {
+		return nil, errors.Wrap(err, "FetchSchema failed")
+	}
+	types := make(map[string]notionapi.PropertyType)
+	for name, prop := range db.Properties {
+		types[name] = prop.Type
+	}
+	return types, nil
+}
+
+// Resolve checks the properties of s against the property types of a
+// database. It returns s with the missing optional fields disabled, or an
+// error listing every mismatch.
+func (s Schema) Resolve(types map[string]notionapi.PropertyType) (Schema, error) {
+	res := make(Schema, len(s))
+	var errs error
+	for _, field := range s.fields() {
+		prop := s[field]
+		if prop.Name == "" {
+			res[field] = prop
+			continue
+		}
+		typ, ok := types[prop.Name]
+		switch {
+		case !ok && prop.Optional:
+			prop.Name = ""
+		case !ok:
+			errs = multierr.Append(errs, errors.Errorf("field %s: database has no property %q", field, prop.Name))
+		case prop.Type != "" && typ != prop.Type:
+			errs = multierr.Append(errs, errors.Errorf("field %s: property %q has type %s, expected %s", field, prop.Name, typ, prop.Type))
+		}
+		res[field] = prop
+	}
+	if errs != nil {
+		return nil, errors.Wrap(errs, "database schema mismatch")
+	}
+	return res, nil
+}
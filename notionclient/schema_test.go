@@ -0,0 +1,125 @@
+package notionclient
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jomei/notionapi"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+var testSchema = Schema{
+	"name": {Name: "Name", Type: notionapi.PropertyTypeTitle},
+	"tags": {Name: "Tags", Type: notionapi.PropertyTypeMultiSelect},
+	"type": {Name: "Type", Type: notionapi.PropertyTypeSelect, Optional: true},
+}
+
+func TestSchemaOverride(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]Property
+		tags      string
+		err       string
+	}{
+		{"rename", map[string]Property{"Tags": {Name: "Labels"}}, "Labels", ""},
+		{"same type", map[string]Property{"tags": {Name: "Labels", Type: notionapi.PropertyTypeMultiSelect}}, "Labels", ""},
+		{"unknown field", map[string]Property{"authors": {Name: "Authors"}}, "", `unknown property field "authors"`},
+		{"type override", map[string]Property{"tags": {Type: notionapi.PropertyTypeSelect}}, "", "field tags: type select is not supported, the property has to be a multi_select"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := testSchema.Override(tt.overrides)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Override error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Override failed: %v", err)
+			}
+			if name := s.Name("tags"); name != tt.tags {
+				t.Errorf("Name(tags) = %q, want %q", name, tt.tags)
+			}
+			if testSchema.Name("tags") != "Tags" {
+				t.Error("Override changed the original schema")
+			}
+		})
+	}
+}
+
+func TestSchemaResolve(t *testing.T) {
+	tests := []struct {
+		name  string
+		types map[string]notionapi.PropertyType
+		typ   string
+		errs  []string
+	}{
+		{
+			name: "all properties",
+			types: map[string]notionapi.PropertyType{
+				"Name": notionapi.PropertyTypeTitle,
+				"Tags": notionapi.PropertyTypeMultiSelect,
+				"Type": notionapi.PropertyTypeSelect,
+			},
+			typ: "Type",
+		},
+		{
+			name: "missing optional property disabled",
+			types: map[string]notionapi.PropertyType{
+				"Name": notionapi.PropertyTypeTitle,
+				"Tags": notionapi.PropertyTypeMultiSelect,
+			},
+			typ: "",
+		},
+		{
+			name: "missing required property",
+			types: map[string]notionapi.PropertyType{
+				"Name": notionapi.PropertyTypeTitle,
+			},
+			errs: []string{`field tags: database has no property "Tags"`},
+		},
+		{
+			name: "wrong types",
+			types: map[string]notionapi.PropertyType{
+				"Name": notionapi.PropertyTypeRichText,
+				"Tags": notionapi.PropertyTypeMultiSelect,
+				"Type": notionapi.PropertyTypeMultiSelect,
+			},
+			errs: []string{
+				`field name: property "Name" has type rich_text, expected title`,
+				`field type: property "Type" has type multi_select, expected select`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := testSchema.Resolve(tt.types)
+			if len(tt.errs) > 0 {
+				if err == nil || !strings.HasPrefix(err.Error(), "database schema mismatch") {
+					t.Fatalf("Resolve error = %v, want a schema mismatch", err)
+				}
+				errs := multierr.Errors(errors.Cause(err))
+				if len(errs) != len(tt.errs) {
+					t.Fatalf("Resolve errors = %v, want %q", errs, tt.errs)
+				}
+				for i, err := range errs {
+					if err.Error() != tt.errs[i] {
+						t.Errorf("error %d = %q, want %q", i, err, tt.errs[i])
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve failed: %v", err)
+			}
+			if name := s.Name("type"); name != tt.typ {
+				t.Errorf("Name(type) = %q, want %q", name, tt.typ)
+			}
+			if name := s.Name("name"); name != "Name" {
+				t.Errorf("Name(name) = %q, want Name", name)
+			}
+		})
+	}
+}
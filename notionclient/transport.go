@@ -0,0 +1,321 @@
+// Package notionclient provides the HTTP client that all Notion API calls go
+// through. It keeps the requests below the rate limit of Notion and retries
+// the ones that were throttled or failed transiently.
+package notionclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRequestsPerSecond is the average rate that Notion allows.
+	DefaultRequestsPerSecond = 3
+	defaultBurst             = 3
+	defaultMaxRetries        = 5
+	baseBackoff              = 500 * time.Millisecond
+	maxBackoff               = 30 * time.Second
+)
+
+// Stats are the counters of a Transport.
+type Stats struct {
+	Requests int64 `json:"requests"`
+	// Retries counts the requests that were sent again.
+	Retries int64 `json:"retries"`
+	// RateLimited counts the 429 responses.
+	RateLimited int64 `json:"rateLimited"`
+	// Throttled is the total time requests waited for the rate limiter.
+	Throttled time.Duration `json:"throttled"`
+	// Backoff is the total time requests waited before being retried.
+	Backoff time.Duration `json:"backoff"`
+}
+
+// limiter is a token bucket. A 429 response pauses it for the time given by
+// Retry-After.
+type limiter struct {
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	lock        sync.Mutex
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (l *limiter) reserve() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	if paused := l.pausedUntil.Sub(now); paused > wait {
+		wait = paused
+	}
+	return wait
+}
+
+func (l *limiter) pause(d time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// Transport is an http.RoundTripper for the Notion API. It limits the rate of
+// requests with a token bucket, honours Retry-After, and retries 429
+// responses with jittered exponential backoff. 409 and 5xx responses and
+// network errors are only retried for idempotent requests.
+type Transport struct {
+	base       http.RoundTripper
+	limiter    *limiter
+	maxRetries int
+	log        *logrus.Logger
+
+	requests    int64
+	retries     int64
+	rateLimited int64
+	throttled   int64
+	backoff     int64
+}
+
+// NewTransport returns a transport that sends up to requestsPerSecond
+// requests per second on average and retries a request up to maxRetries
+// times. Defaults are used for values that are not positive.
+func NewTransport(requestsPerSecond float64, burst int, maxRetries int, log *logrus.Logger) *Transport {
+	if requestsPerSecond <= 0 {
+		requestsPerSecond = DefaultRequestsPerSecond
+	}
+	if burst <= 0 {
+		burst = defaultBurst
+	}
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+	return &Transport{
+		base: http.DefaultTransport,
+		limiter: &limiter{
+			rate:   requestsPerSecond,
+			burst:  float64(burst),
+			tokens: float64(burst),
+			last:   time.Now(),
+		},
+		maxRetries: maxRetries,
+		log:        log,
+	}
+}
+
+// Client returns an HTTP client that uses the transport.
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+// Stats returns the counters since the transport was created.
+func (t *Transport) Stats() Stats {
+	return Stats{
+		Requests:    atomic.LoadInt64(&t.requests),
+		Retries:     atomic.LoadInt64(&t.retries),
+		RateLimited: atomic.LoadInt64(&t.rateLimited),
+		Throttled:   time.Duration(atomic.LoadInt64(&t.throttled)),
+		Backoff:     time.Duration(atomic.LoadInt64(&t.backoff)),
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// idempotent reports whether req can be sent again after Notion may have
+// handled it. Repeating a POST could, e.g., create a page twice, except for
+// the POSTs that only read.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPatch, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return strings.HasSuffix(req.URL.Path, "/query") || strings.HasSuffix(req.URL.Path, "/search")
+	}
+	return false
+}
+
+// retryable reports whether a response with status is retried. Requests
+// that are not idempotent are only retried when they were rate limited,
+// since Notion has not handled them then.
+func retryable(req *http.Request, status int) bool {
+	if status == http.StatusTooManyRequests {
+		return true
+	}
+	return idempotent(req) && (status == http.StatusConflict || status >= 500)
+}
+
+// unsent reports whether err happened before req reached Notion, so that
+// it can be retried even if it is not idempotent.
+func unsent(req *http.Request, err error) bool {
+	if idempotent(req) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryAfter returns the delay requested by the Retry-After header in
+// seconds, or zero.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// jitteredBackoff returns a random delay of up to twice the exponential
+// backoff of the attempt.
+func jitteredBackoff(attempt int) time.Duration {
+	d := baseBackoff << uint(attempt)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	// The body is buffered so that it can be sent again.
+	getBody := req.GetBody
+	if req.Body != nil && getBody == nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		getBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		wait := t.limiter.reserve()
+		atomic.AddInt64(&t.throttled, int64(wait))
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+
+		r := req
+		if getBody != nil && (attempt > 0 || req.GetBody == nil) {
+			r = req.Clone(ctx)
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		atomic.AddInt64(&t.requests, 1)
+		resp, err := t.base.RoundTrip(r)
+
+		var delay time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || attempt >= t.maxRetries || !unsent(req, err) {
+				return nil, err
+			}
+			delay = jitteredBackoff(attempt)
+		case !retryable(req, resp.StatusCode) || attempt >= t.maxRetries:
+			return resp, nil
+		default:
+			delay = retryAfter(resp)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				atomic.AddInt64(&t.rateLimited, 1)
+				if delay == 0 {
+					delay = jitteredBackoff(attempt)
+				}
+				// Every request waits, not only this one.
+				t.limiter.pause(delay)
+			} else if delay == 0 {
+				delay = jitteredBackoff(attempt)
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		fields := logrus.Fields{
+			"Method":  req.Method,
+			"Path":    req.URL.Path,
+			"Attempt": attempt + 1,
+			"Delay":   delay,
+		}
+		if err != nil {
+			fields["Error"] = err
+		} else {
+			fields["Status"] = resp.StatusCode
+		}
+		t.log.WithFields(fields).Warn("Retrying Notion request")
+		atomic.AddInt64(&t.retries, 1)
+		atomic.AddInt64(&t.backoff, int64(delay))
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// StatsHandler serves the Stats of a Transport as JSON.
+type StatsHandler struct {
+	token string
+	t     *Transport
+}
+
+// NewStatsHandler returns a handler for the stats of t. Requests have to
+// carry token as bearer token.
+func NewStatsHandler(token string, t *Transport) *StatsHandler {
+	return &StatsHandler{
+		token: token,
+		t:     t,
+	}
+}
+
+func (sh *StatsHandler) handleStats(w http.ResponseWriter, r *http.Request) {
+	expected := "Bearer " + sh.token
+	if sh.token == "" || !hmac.Equal([]byte(r.Header.Get("Authorization")), []byte(expected)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sh.t.Stats())
+}
+
+func (sh *StatsHandler) HandleFuncs(router *mux.Router) {
+	router.HandleFunc("", sh.handleStats).Methods("GET")
+}
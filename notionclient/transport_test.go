@@ -0,0 +1,133 @@
+package notionclient
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// recordingServer answers requests with the statuses in order and records
+// the bodies it received.
+type recordingServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func newRecordingServer(t *testing.T, statuses ...int) *recordingServer {
+	rs := &recordingServer{statuses: statuses}
+	rs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rs.lock.Lock()
+		defer rs.lock.Unlock()
+		rs.bodies = append(rs.bodies, string(body))
+		status := http.StatusOK
+		if len(rs.statuses) > 0 {
+			status, rs.statuses = rs.statuses[0], rs.statuses[1:]
+		}
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rs.Close)
+	return rs
+}
+
+func newTestTransport() *Transport {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return NewTransport(100, 10, 3, log)
+}
+
+// unbufferedBody hides the type of the reader, so that the request has no
+// GetBody and the transport has to buffer the body itself.
+func unbufferedBody(s string) io.Reader {
+	return io.MultiReader(strings.NewReader(s))
+}
+
+func TestTransportRetriesRateLimited(t *testing.T) {
+	rs := newRecordingServer(t, http.StatusTooManyRequests, http.StatusOK)
+	tr := newTestTransport()
+
+	resp, err := tr.Client().Get(rs.URL + "/v1/pages/page")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	stats := tr.Stats()
+	if stats.Requests != 2 || stats.Retries != 1 || stats.RateLimited != 1 {
+		t.Errorf("Stats = %+v, want 2 requests, 1 retry and 1 rate limited", stats)
+	}
+	if stats.Backoff < time.Second {
+		t.Errorf("Backoff = %v, want the Retry-After of 1s", stats.Backoff)
+	}
+}
+
+func TestTransportDoesNotRetryCreate(t *testing.T) {
+	rs := newRecordingServer(t, http.StatusBadGateway, http.StatusOK)
+	tr := newTestTransport()
+
+	resp, err := tr.Client().Post(rs.URL+"/v1/pages", "application/json", unbufferedBody(`{"parent": {}}`))
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	if len(rs.bodies) != 1 {
+		t.Errorf("page create was sent %d times, want once", len(rs.bodies))
+	}
+	if stats := tr.Stats(); stats.Retries != 0 {
+		t.Errorf("Retries = %d, want 0", stats.Retries)
+	}
+}
+
+func TestTransportRetriesQueryWithBody(t *testing.T) {
+	rs := newRecordingServer(t, http.StatusBadGateway, http.StatusOK)
+	tr := newTestTransport()
+
+	const body = `{"page_size": 100}`
+	resp, err := tr.Client().Post(rs.URL+"/v1/databases/db/query", "application/json", unbufferedBody(body))
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if len(rs.bodies) != 2 || rs.bodies[0] != body || rs.bodies[1] != body {
+		t.Errorf("received bodies %q, want %q twice", rs.bodies, body)
+	}
+	if stats := tr.Stats(); stats.Retries != 1 {
+		t.Errorf("Retries = %d, want 1", stats.Retries)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{rate: 10, burst: 2, tokens: 2, last: time.Now()}
+	for i := 0; i < 2; i++ {
+		if wait := l.reserve(); wait != 0 {
+			t.Errorf("reserve %d of the burst = %v, want no wait", i, wait)
+		}
+	}
+	if wait := l.reserve(); wait < 90*time.Millisecond || wait > 100*time.Millisecond {
+		t.Errorf("reserve after the burst = %v, want about 100ms", wait)
+	}
+	l.pause(time.Second)
+	if wait := l.reserve(); wait < 900*time.Millisecond {
+		t.Errorf("reserve while paused = %v, want about 1s", wait)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/shayanh/notionify/notionclient"
 	"github.com/sirupsen/logrus"
 )
 
@@ -27,7 +28,9 @@ func dateEquals(a, b time.Time) bool {
 
 func (th *TasksHandler) Handle(ctx context.Context) error {
 	tasks, err := th.nh.ListTasks(ctx)
-	if err != nil {
+	if notionclient.IsMalformed(err) {
+		th.log.Warn(err)
+	} else if err != nil {
 		return err
 	}
 	for _, task := range tasks {
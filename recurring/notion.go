@@ -3,9 +3,12 @@ package recurring
 import (
 	"context"
 	"encoding/json"
+	"net/http"
 	"time"
 
 	"github.com/jomei/notionapi"
+	"github.com/pkg/errors"
+	"github.com/shayanh/notionify/notionclient"
 	"github.com/sirupsen/logrus"
 )
 
@@ -30,63 +33,91 @@ func debugJSON(obj interface{}) {
 	logrus.Debug(string(b))
 }
 
-func NewNotionTask(page *notionapi.Page) *NotionTask {
-	res := new(NotionTask)
-	res.ID = string(page.ID)
-
-	nameProp := page.Properties["Name"]
-	if nameProp != nil {
-		titles := nameProp.(*notionapi.PageTitleProperty).Title
-		if len(titles) > 0 {
-			res.Name = titles[0].PlainText
-		}
-	}
+// Logical fields of the tasks database. Their property names and types are
+// configurable.
+const (
+	FieldName    = "name"
+	FieldStatus  = "status"
+	FieldTags    = "tags"
+	FieldDueDate = "duedate"
+)
 
-	statusProp := page.Properties["Status"]
-	if statusProp != nil {
-		res.Status = statusProp.(*notionapi.SelectOptionProperty).Select.Name
-	}
+// DefaultSchema is the layout of the tasks database that is used unless
+// configured otherwise.
+var DefaultSchema = notionclient.Schema{
+	FieldName:    {Name: "Name", Type: notionapi.PropertyTypeTitle},
+	FieldStatus:  {Name: "Status", Type: notionapi.PropertyTypeSelect},
+	FieldTags:    {Name: "Tags", Type: notionapi.PropertyTypeMultiSelect},
+	FieldDueDate: {Name: "Due Date", Type: notionapi.PropertyTypeDate},
+}
 
-	tagsProp := page.Properties["Tags"]
-	if tagsProp != nil {
-		res.Tags = func(options []notionapi.Option) []string {
-			var names []string
-			for _, option := range options {
-				names = append(names, option.Name)
-			}
-			return names
-		}(tagsProp.(*notionapi.MultiSelectOptionsProperty).MultiSelect)
+// NewNotionTask decodes a page of the tasks database. Properties of
+// unexpected types are reported as notionclient.PropertyErrors, and the task
+// is returned with the other properties.
+func NewNotionTask(page *notionapi.Page, schema notionclient.Schema) (*NotionTask, error) {
+	d := notionclient.NewDecoder(page)
+	res := &NotionTask{
+		ID:     string(page.ID),
+		Name:   d.Title(schema.Name(FieldName)),
+		Status: d.Select(schema.Name(FieldStatus)),
+		Tags:   d.MultiSelect(schema.Name(FieldTags)),
 	}
-
-	dueDateProp := page.Properties["Due Date"]
-	if dueDateProp != nil {
-		dueDateStr := dueDateProp.(*notionapi.DateProperty).Date.Start
-		res.DueDate, _ = time.Parse(isoLayout, dueDateStr)
+	if dueDate := d.Date(schema.Name(FieldDueDate)); dueDate != "" {
+		res.DueDate, _ = time.Parse(isoLayout, dueDate)
 	}
-	return res
+	return res, d.Err()
 }
 
 type NotionHandler struct {
 	databaseID notionapi.DatabaseID
+	token      string
+	schema     notionclient.Schema
 	nc         *notionapi.Client
+	client     *http.Client
 }
 
-func NewNotionHandler(token string, databaseID string) *NotionHandler {
+// NewNotionHandler returns a handler for the tasks database. DefaultSchema is
+// used when schema is nil.
+func NewNotionHandler(token string, databaseID string, schema notionclient.Schema, client *http.Client) *NotionHandler {
+	if schema == nil {
+		schema = DefaultSchema
+	}
 	return &NotionHandler{
-		nc:         notionapi.NewClient(notionapi.Token(token)),
+		nc:         notionapi.NewClient(notionapi.Token(token), notionapi.WithHTTPClient(client)),
+		token:      token,
 		databaseID: notionapi.DatabaseID(databaseID),
+		schema:     schema,
+		client:     client,
 	}
 }
 
-// ListTasks lists all recurring tasks
+// ValidateSchema checks the configured properties against the schema of the
+// database.
+func (nh *NotionHandler) ValidateSchema(ctx context.Context) error {
+	types, err := notionclient.FetchSchema(ctx, nh.client, nh.token, nh.databaseID.String())
+	if err != nil {
+		return errors.Wrap(err, "notion handler ValidateSchema failed")
+	}
+	schema, err := nh.schema.Resolve(types)
+	if err != nil {
+		return errors.Wrapf(err, "notion handler ValidateSchema failed for database %s", nh.databaseID)
+	}
+	nh.schema = schema
+	return nil
+}
+
+// ListTasks lists all recurring tasks. Tasks that cannot be decoded are left
+// out and reported by a notionclient.MalformedPagesError, which is returned
+// along with the other tasks.
 func (nh *NotionHandler) ListTasks(ctx context.Context) ([]*NotionTask, error) {
 	var tasks []*NotionTask
+	var malformed []error
 	var cursor notionapi.Cursor
 	for hasMore := true; hasMore; {
 		req := &notionapi.DatabaseQueryRequest{
 			Sorts: []notionapi.SortObject{},
 			Filter: map[string]interface{}{
-				"property": "Tags",
+				"property": nh.schema.Name(FieldTags),
 				"multi_select": map[string]interface{}{
 					"contains": tagRecurring,
 				},
@@ -98,11 +129,19 @@ func (nh *NotionHandler) ListTasks(ctx context.Context) ([]*NotionTask, error) {
 			return nil, err
 		}
 		for _, page := range resp.Results {
-			tasks = append(tasks, NewNotionTask(&page))
+			task, err := NewNotionTask(&page, nh.schema)
+			if err != nil {
+				malformed = append(malformed, err)
+				continue
+			}
+			tasks = append(tasks, task)
 		}
 		hasMore = resp.HasMore
 		cursor = resp.NextCursor
 	}
+	if len(malformed) > 0 {
+		return tasks, &notionclient.MalformedPagesError{Errs: malformed}
+	}
 	return tasks, nil
 }
 
@@ -111,7 +150,7 @@ func (nh *NotionHandler) UpdateTask(ctx context.Context, t *NotionTask) (*Notion
 	// It doesn't work with one request, wtf
 	req := &notionapi.PageUpdateRequest{
 		Properties: notionapi.Properties{
-			"Due Date": notionapi.DateProperty{
+			nh.schema.Name(FieldDueDate): notionapi.DateProperty{
 				Type: notionapi.PropertyTypeDate,
 				Date: notionapi.Date{
 					Start: t.DueDate.Format(isoLayout),
@@ -126,7 +165,7 @@ func (nh *NotionHandler) UpdateTask(ctx context.Context, t *NotionTask) (*Notion
 
 	req = &notionapi.PageUpdateRequest{
 		Properties: notionapi.Properties{
-			"Status": func() *notionapi.SelectOptionProperty {
+			nh.schema.Name(FieldStatus): func() *notionapi.SelectOptionProperty {
 				if t.Status == "" {
 					return nil
 				}
@@ -141,5 +180,8 @@ func (nh *NotionHandler) UpdateTask(ctx context.Context, t *NotionTask) (*Notion
 	if err != nil {
 		return nil, err
 	}
-	return NewNotionTask(page), err
+	// The task has been updated, so properties that cannot be decoded are
+	// left empty instead of failing the update.
+	task, _ := NewNotionTask(page, nh.schema)
+	return task, nil
 }
@@ -0,0 +1,216 @@
+package research
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiveRules selects the pages whose linked file NotionSyncerImpl archives.
+// Pages without a URL, and pages that belong to a synchronized file, are
+// never archived.
+type ArchiveRules struct {
+	// Types are the page types that are archived. Pages of any type are
+	// archived when it is empty.
+	Types []string
+	// Tags restricts archiving to pages with one of the tags.
+	Tags []string
+	// SkipHosts are hosts, including their subdomains, whose links are not
+	// archived, e.g. because they already point to a storage provider.
+	SkipHosts []string
+}
+
+// DefaultArchiveRules archives papers that are not in Dropbox yet.
+var DefaultArchiveRules = ArchiveRules{
+	Types:     []string{"paper"},
+	SkipHosts: []string{"dropbox.com", "dropboxusercontent.com"},
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether the URL of page is archived.
+func (r ArchiveRules) Match(page *NotionPage) bool {
+	if page.URL == "" || page.SourceID != "" {
+		return false
+	}
+	if len(r.Types) > 0 && !containsFold(r.Types, page.Type) {
+		return false
+	}
+	if len(r.Tags) > 0 {
+		tagged := false
+		for _, tag := range page.Tags {
+			tagged = tagged || containsFold(r.Tags, tag)
+		}
+		if !tagged {
+			return false
+		}
+	}
+	u, err := url.Parse(page.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, skip := range r.SkipHosts {
+		skip = strings.ToLower(skip)
+		if host == skip || strings.HasSuffix(host, "."+skip) {
+			return false
+		}
+	}
+	return true
+}
+
+// downloadURL returns the URL of the PDF of a landing page that is known to
+// link to one, e.g. https://arxiv.org/pdf/1706.03762 for
+// https://arxiv.org/abs/1706.03762. Other URLs are returned unchanged.
+// Redirects are followed when the file is downloaded.
+func downloadURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	switch strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") {
+	case "arxiv.org":
+		if id := strings.TrimPrefix(u.Path, "/abs/"); id != u.Path && id != "" {
+			return "https://arxiv.org/pdf/" + id
+		}
+	case "openreview.net":
+		if id := u.Query().Get("id"); u.Path == "/forum" && id != "" {
+			return "https://openreview.net/pdf?id=" + url.QueryEscape(id)
+		}
+	}
+	return rawURL
+}
+
+// isPDF reports whether resp is a PDF file. Servers that do not know the
+// type of a file with a .pdf extension are trusted.
+func isPDF(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/pdf", "application/x-pdf":
+		return true
+	case "", "application/octet-stream", "binary/octet-stream":
+		return strings.EqualFold(path.Ext(resp.Request.URL.Path), ".pdf")
+	}
+	return false
+}
+
+// archiveFileName returns the name of the archived file of page, which was
+// downloaded from u.
+func archiveFileName(page *NotionPage, u *url.URL) string {
+	name := strings.TrimSpace(strings.NewReplacer("/", "-", "\\", "-", ":", " -").Replace(page.Name))
+	if name == "" {
+		name = path.Base(u.Path)
+		if name == "/" || name == "." {
+			name = page.ID
+		}
+	}
+	if !strings.EqualFold(path.Ext(name), ".pdf") {
+		name += ".pdf"
+	}
+	return name
+}
+
+func getArchiveSkippedKey(pageID string) string {
+	return "archive-skipped-" + pageID
+}
+
+// archiveInterval is how often NotionSyncerImpl.Run archives pages when no
+// interval is given.
+const archiveInterval = time.Hour
+
+// Run archives the pages of the database every interval until ctx is done.
+func (ns *NotionSyncerImpl) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = archiveInterval
+	}
+	for {
+		ns.archive(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (ns *NotionSyncerImpl) archive(ctx context.Context) {
+	cloudFiles, err := ns.SyncDatabase(ctx)
+	if err != nil {
+		ns.log.Error(err)
+	}
+	for _, c := range cloudFiles {
+		ns.log.WithFields(logrus.Fields{
+			"Path":   c.Path,
+			"FileID": c.FileID,
+		}).Info("Archived page")
+	}
+}
+
+// ArchiveHandler archives the pages of the databases on request, e.g. from a
+// Notion automation. Requests that arrive while the pages are archived are
+// coalesced into one more run.
+type ArchiveHandler struct {
+	token   string
+	syncers []*NotionSyncerImpl
+	trigger chan struct{}
+	log     *logrus.Logger
+}
+
+// NewArchiveHandler returns a handler that runs syncers. Requests have to
+// carry token as bearer token. Run has to be running to serve them.
+func NewArchiveHandler(token string, syncers []*NotionSyncerImpl, log *logrus.Logger) *ArchiveHandler {
+	return &ArchiveHandler{
+		token:   token,
+		syncers: syncers,
+		trigger: make(chan struct{}, 1),
+		log:     log,
+	}
+}
+
+// Run archives the pages of the databases whenever it has been requested,
+// until ctx is done.
+func (ah *ArchiveHandler) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ah.trigger:
+		}
+		for _, ns := range ah.syncers {
+			ns.archive(ctx)
+		}
+	}
+}
+
+// handleArchive requests archiving and responds before it is done, since
+// downloads can take longer than the caller waits.
+func (ah *ArchiveHandler) handleArchive(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, ah.token) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	select {
+	case ah.trigger <- struct{}{}:
+	default:
+		// A run is already pending.
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (ah *ArchiveHandler) HandleFuncs(router *mux.Router) {
+	router.HandleFunc("", ah.handleArchive).Methods("POST")
+}
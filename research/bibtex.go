@@ -0,0 +1,188 @@
+package research
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ParseBibTeX returns the metadata of the entries of a BibTeX database. It
+// supports braced, quoted and numeric field values, and ignores string
+// macros and concatenations.
+func ParseBibTeX(data string) []*Metadata {
+	var entries []*Metadata
+	p := &bibParser{data: data}
+	for p.skipTo('@') {
+		entryType := strings.ToLower(p.readIdent())
+		p.skipSpace()
+		if !p.consume('{') && !p.consume('(') {
+			continue
+		}
+		if entryType == "comment" || entryType == "string" || entryType == "preamble" {
+			p.readBraced()
+			continue
+		}
+		p.readUntil(",}")
+		fields := make(map[string]string)
+		for {
+			p.skipSpace()
+			if p.consume('}') || p.consume(')') || p.eof() {
+				break
+			}
+			if p.consume(',') {
+				continue
+			}
+			name := strings.ToLower(p.readIdent())
+			p.skipSpace()
+			if name == "" || !p.consume('=') {
+				p.readUntil(",}")
+				continue
+			}
+			p.skipSpace()
+			fields[name] = cleanBibValue(p.readValue())
+		}
+		entries = append(entries, bibMetadata(fields))
+	}
+	return entries
+}
+
+func bibMetadata(fields map[string]string) *Metadata {
+	md := &Metadata{
+		Title: fields["title"],
+		DOI:   fields["doi"],
+	}
+	for _, author := range strings.Split(fields["author"], " and ") {
+		if author = strings.TrimSpace(author); author != "" {
+			md.Authors = append(md.Authors, bibAuthorName(author))
+		}
+	}
+	md.Year, _ = strconv.Atoi(fields["year"])
+	for _, venue := range []string{"journal", "booktitle", "publisher"} {
+		if fields[venue] != "" {
+			md.Venue = fields[venue]
+			break
+		}
+	}
+	if strings.EqualFold(fields["archiveprefix"], "arxiv") || strings.EqualFold(fields["eprinttype"], "arxiv") {
+		md.ArXivID = fields["eprint"]
+	}
+	if md.ArXivID == "" {
+		md.ArXivID = FindArXivID(fields["url"])
+	}
+	return md
+}
+
+// bibAuthorName turns "Family, Given" into "Given Family".
+func bibAuthorName(author string) string {
+	parts := strings.SplitN(author, ",", 2)
+	if len(parts) != 2 {
+		return author
+	}
+	return strings.TrimSpace(parts[1]) + " " + strings.TrimSpace(parts[0])
+}
+
+func cleanBibValue(value string) string {
+	value = strings.NewReplacer("{", "", "}", "").Replace(value)
+	return strings.Join(strings.Fields(value), " ")
+}
+
+type bibParser struct {
+	data string
+	pos  int
+}
+
+func (p *bibParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *bibParser) skipTo(ch byte) bool {
+	i := strings.IndexByte(p.data[p.pos:], ch)
+	if i < 0 {
+		p.pos = len(p.data)
+		return false
+	}
+	p.pos += i + 1
+	return true
+}
+
+func (p *bibParser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(rune(p.data[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *bibParser) consume(ch byte) bool {
+	if !p.eof() && p.data[p.pos] == ch {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *bibParser) readIdent() string {
+	start := p.pos
+	for !p.eof() {
+		ch := p.data[p.pos]
+		if !(ch == '_' || ch == '-' || ch == ':' || ch == '.' || unicode.IsLetter(rune(ch)) || unicode.IsDigit(rune(ch))) {
+			break
+		}
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+func (p *bibParser) readUntil(chars string) string {
+	start := p.pos
+	for !p.eof() && strings.IndexByte(chars, p.data[p.pos]) < 0 {
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+// readBraced reads up to the brace that closes an already consumed opening
+// brace.
+func (p *bibParser) readBraced() string {
+	start := p.pos
+	depth := 1
+	for !p.eof() {
+		switch p.data[p.pos] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				value := p.data[start:p.pos]
+				p.pos++
+				return value
+			}
+		}
+		p.pos++
+	}
+	return p.data[start:]
+}
+
+func (p *bibParser) readValue() string {
+	switch {
+	case p.consume('{'):
+		return p.readBraced()
+	case p.consume('"'):
+		start := p.pos
+		depth := 0
+		for !p.eof() {
+			ch := p.data[p.pos]
+			if ch == '{' {
+				depth++
+			} else if ch == '}' {
+				depth--
+			} else if ch == '"' && depth == 0 {
+				value := p.data[start:p.pos]
+				p.pos++
+				return value
+			}
+			p.pos++
+		}
+		return p.data[start:]
+	default:
+		return strings.TrimSpace(p.readUntil(",}"))
+	}
+}
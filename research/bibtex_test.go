@@ -0,0 +1,48 @@
+package research
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBibTeX(t *testing.T) {
+	const data = `
+@comment{ignored {nested} entry}
+@string{naacl = "NAACL"}
+@article{devlin2019,
+  title = {The {BERT}
+           Model},
+  author = "Devlin, Jacob and Ming-Wei Chang",
+  year = 2019,
+  journal = "Proc. {"}NAACL{"}",
+  eprint = {1810.04805}, archivePrefix = {arXiv},
+}
+@inproceedings(vaswani2017, title = "Attention Is {All} You Need",
+  booktitle = {NeurIPS}, url = {https://arxiv.org/abs/1706.03762},
+  doi = {10.5555/3295222.3295349})
+`
+	want := []*Metadata{
+		{
+			Title:   "The BERT Model",
+			Authors: []string{"Jacob Devlin", "Ming-Wei Chang"},
+			Year:    2019,
+			Venue:   `Proc. "NAACL"`,
+			ArXivID: "1810.04805",
+		},
+		{
+			Title:   "Attention Is All You Need",
+			Venue:   "NeurIPS",
+			DOI:     "10.5555/3295222.3295349",
+			ArXivID: "1706.03762",
+		},
+	}
+	got := ParseBibTeX(data)
+	if len(got) != len(want) {
+		t.Fatalf("ParseBibTeX returned %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
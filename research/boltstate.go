@@ -0,0 +1,176 @@
+package research
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltValuesBucket = []byte("values")
+	boltHashesBucket = []byte("hashes")
+)
+
+// BoltStateStore is a StateStore in a bbolt database file, for installations
+// without redis. The file can only be opened by one process, so locks are
+// kept in memory.
+type BoltStateStore struct {
+	db    *bolt.DB
+	locks localLocks
+}
+
+func NewBoltStateStore(path string) (*BoltStateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open state file")
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltValuesBucket, boltHashesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "cannot open state file")
+	}
+	return &BoltStateStore{db: db}, nil
+}
+
+func (bs *BoltStateStore) Close() error {
+	return bs.db.Close()
+}
+
+func (bs *BoltStateStore) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltValuesBucket).Get([]byte(key))
+		if v == nil {
+			return ErrStateNotFound
+		}
+		value = string(v)
+		return nil
+	})
+	return value, err
+}
+
+func (bs *BoltStateStore) Set(ctx context.Context, key string, value string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltValuesBucket).Put([]byte(key), []byte(value))
+	})
+}
+
+func (bs *BoltStateStore) Delete(ctx context.Context, keys ...string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return deleteKeys(tx, keys)
+	})
+}
+
+// deleteKeys deletes the values and hashes of keys.
+func deleteKeys(tx *bolt.Tx, keys []string) error {
+	values := tx.Bucket(boltValuesBucket)
+	hashes := tx.Bucket(boltHashesBucket)
+	for _, key := range keys {
+		if err := values.Delete([]byte(key)); err != nil {
+			return err
+		}
+		if hashes.Bucket([]byte(key)) != nil {
+			if err := hashes.DeleteBucket([]byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (bs *BoltStateStore) Apply(ctx context.Context, set map[string]string, del []string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteKeys(tx, del); err != nil {
+			return err
+		}
+		values := tx.Bucket(boltValuesBucket)
+		for key, value := range set {
+			if err := values.Put([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStateStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltValuesBucket).Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (bs *BoltStateStore) GetField(ctx context.Context, key string, field string) (string, error) {
+	var value string
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		hash := tx.Bucket(boltHashesBucket).Bucket([]byte(key))
+		if hash == nil {
+			return ErrStateNotFound
+		}
+		v := hash.Get([]byte(field))
+		if v == nil {
+			return ErrStateNotFound
+		}
+		value = string(v)
+		return nil
+	})
+	return value, err
+}
+
+func (bs *BoltStateStore) SetField(ctx context.Context, key string, field string, value string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		hash, err := tx.Bucket(boltHashesBucket).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		return hash.Put([]byte(field), []byte(value))
+	})
+}
+
+func (bs *BoltStateStore) DeleteField(ctx context.Context, key string, field string) (bool, error) {
+	existed := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		hash := tx.Bucket(boltHashesBucket).Bucket([]byte(key))
+		if hash == nil {
+			return nil
+		}
+		existed = hash.Get([]byte(field)) != nil
+		return hash.Delete([]byte(field))
+	})
+	return existed, err
+}
+
+func (bs *BoltStateStore) Fields(ctx context.Context, key string) (map[string]string, error) {
+	fields := make(map[string]string)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		hash := tx.Bucket(boltHashesBucket).Bucket([]byte(key))
+		if hash == nil {
+			return nil
+		}
+		return hash.ForEach(func(k, v []byte) error {
+			fields[string(k)] = string(v)
+			return nil
+		})
+	})
+	return fields, err
+}
+
+func (bs *BoltStateStore) Lock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	return bs.locks.acquire(name, ttl)
+}
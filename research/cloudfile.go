@@ -1,20 +1,123 @@
 package research
 
-import "io"
+import (
+	"io"
+	"path"
+	"strings"
+)
 
 // CloudFile represents a file that is stored in the cloud.
 type CloudFile struct {
 	FileID   string
+	Path     string
 	Title    string
 	URL      string
 	Tags     []string
 	Provider string
+	// Namespace separates the files of different accounts of the same
+	// provider in the state. It is empty when only one account is
+	// synchronized.
+	Namespace string
+	// ContentHash is the hash of the content of the file, if the provider
+	// reports one.
+	ContentHash string
+	// Folders are the folders between the synchronized root and the file.
+	Folders []string
+
+	// Metadata filled in by extractors.
+	Authors   []string
+	Year      int
+	DOI       string
+	ArXivID   string
+	Venue     string
+	Abstract  string
+	Keywords  []string
+	PageCount int
+}
+
+// SourceID identifies the file across providers. It is written to the Notion
+// page of the file.
+func (c CloudFile) SourceID() string {
+	return c.Provider + ":" + c.FileID
+}
+
+// keySpace is the part of the state keys of the file that identifies its
+// provider and account.
+func (c CloudFile) keySpace() string {
+	if c.Namespace == "" {
+		return c.Provider
+	}
+	return c.Provider + "-" + c.Namespace
 }
 
 func (c CloudFile) GetKey() string {
-	return "cloudfile-" + c.Provider + "-" + c.FileID
+	return "cloudfile-" + c.keySpace() + "-" + c.FileID
+}
+
+// GetPathKey returns the key of the reverse index that maps the file's path to
+// its ID. Deleted entries only carry a path, so this is the only way to find
+// their Notion page.
+func (c CloudFile) GetPathKey() string {
+	return "cloudpath-" + c.keySpace() + "-" + strings.ToLower(c.Path)
+}
+
+// GetLastPathKey returns the key that stores the last synchronized path of the
+// file.
+func (c CloudFile) GetLastPathKey() string {
+	return "cloudfile-path-" + c.keySpace() + "-" + c.FileID
+}
+
+// GetLastTitleKey returns the key that stores the last title written to the
+// file's Notion page.
+func (c CloudFile) GetLastTitleKey() string {
+	return "cloudfile-title-" + c.keySpace() + "-" + c.FileID
+}
+
+// GetLastFolderValuesKey returns the key that stores the folder values last
+// written to the file's Notion page.
+func (c CloudFile) GetLastFolderValuesKey() string {
+	return "cloudfile-folders-" + c.keySpace() + "-" + c.FileID
+}
+
+// GetContentHashKey returns the key that stores the content hash of the file
+// when it was last synchronized.
+func (c CloudFile) GetContentHashKey() string {
+	return "cloudfile-hash-" + c.keySpace() + "-" + c.FileID
+}
+
+// GetDuplicateKey returns the key that stores the page of the file it is a
+// duplicate of.
+func (c CloudFile) GetDuplicateKey() string {
+	return "cloudfile-duplicate-" + c.keySpace() + "-" + c.FileID
+}
+
+// getHashIndexKey returns the key of the index that maps a content hash to
+// the page of the first file with that content. keySpace is the one of the
+// files, so that the files of different accounts are not duplicates of each
+// other.
+func getHashIndexKey(keySpace string, hash string) string {
+	return "contenthash-" + keySpace + "-" + hash
 }
 
 type CloudUploader interface {
 	Upload(cloudFilePath string, content io.Reader) (*CloudFile, error)
 }
+
+// FolderSegments returns the folders between root and the file at filePath,
+// or nil if the file is not below root. The comparison with root is
+// case-insensitive.
+func FolderSegments(root string, filePath string) []string {
+	dir := path.Dir(filePath)
+	root = strings.TrimSuffix(path.Clean("/"+root), "/")
+	lowerDir, lowerRoot := strings.ToLower(dir), strings.ToLower(root)
+	if lowerDir != lowerRoot && !strings.HasPrefix(lowerDir, lowerRoot+"/") {
+		return nil
+	}
+	var segments []string
+	for _, segment := range strings.Split(dir[len(root):], "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
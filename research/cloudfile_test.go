@@ -0,0 +1,27 @@
+package research
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFolderSegments(t *testing.T) {
+	tests := []struct {
+		root     string
+		filePath string
+		want     []string
+	}{
+		{"/", "/a.pdf", nil},
+		{"", "/ml/nlp/a.pdf", []string{"ml", "nlp"}},
+		{"/papers", "/papers/a.pdf", nil},
+		{"/papers/", "/papers/ml/a.pdf", []string{"ml"}},
+		{"/Papers", "/papers/ML/a.pdf", []string{"ML"}},
+		{"/papers", "/papers-old/ml/a.pdf", nil},
+		{"/papers", "/other/a.pdf", nil},
+	}
+	for _, tt := range tests {
+		if got := FolderSegments(tt.root, tt.filePath); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FolderSegments(%q, %q) = %q, want %q", tt.root, tt.filePath, got, tt.want)
+		}
+	}
+}
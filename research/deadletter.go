@@ -0,0 +1,360 @@
+package research
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is an entry that failed with an error that is not transient.
+// Later synchronizations of its folder retry it with increasing backoff, and
+// it is synchronized again when it changes. It can also be retried or
+// discarded through the DeadLetterHandler.
+type DeadLetter struct {
+	Entry *StorageEntry `json:"entry"`
+	// Root is the synchronized folder the entry was listed in.
+	Root     string    `json:"root"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failedAt"`
+	// NextRetry is when later synchronizations retry the entry.
+	NextRetry time.Time `json:"nextRetry"`
+}
+
+const (
+	// deadLetterBackoff is the delay before a dead letter is retried for the
+	// first time. It doubles with every failed retry.
+	deadLetterBackoff = 10 * time.Minute
+	// maxDeadLetterBackoff is the longest delay between retries.
+	maxDeadLetterBackoff = 24 * time.Hour
+)
+
+// failed records that the entry of dl failed again with err.
+func (dl *DeadLetter) failed(err error) {
+	dl.Error = err.Error()
+	dl.Attempts += syncAttempts
+	dl.FailedAt = time.Now()
+	backoff := deadLetterBackoff
+	for i := syncAttempts; i < dl.Attempts && backoff < maxDeadLetterBackoff; i += syncAttempts {
+		backoff *= 2
+	}
+	if backoff > maxDeadLetterBackoff {
+		backoff = maxDeadLetterBackoff
+	}
+	dl.NextRetry = dl.FailedAt.Add(backoff)
+}
+
+// deadLetteredError is the error of an entry that has been dead-lettered.
+type deadLetteredError struct {
+	error
+}
+
+// IsDeadLettered reports whether all errors combined in err belong to
+// dead-lettered entries. Repeating the synchronization cannot fix them.
+func IsDeadLettered(err error) bool {
+	errs := multierr.Errors(err)
+	for _, err := range errs {
+		if _, ok := err.(deadLetteredError); !ok {
+			return false
+		}
+	}
+	return len(errs) > 0
+}
+
+// Name identifies the synchronizer in the dead letter API.
+func (fs *FolderSynchronizer) Name() string {
+	name := fs.cb.Provider().Name()
+	if ns := fs.cb.Namespace(); ns != "" {
+		name += "-" + ns
+	}
+	return name
+}
+
+func (fs *FolderSynchronizer) getDeadLettersKey() string {
+	return "deadletters-" + fs.Name()
+}
+
+func (fs *FolderSynchronizer) getDeadLetter(ctx context.Context, path string) (*DeadLetter, error) {
+	val, err := fs.ss.GetField(ctx, fs.getDeadLettersKey(), strings.ToLower(path))
+	if err == ErrStateNotFound {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dl DeadLetter
+	if err := json.Unmarshal([]byte(val), &dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+func (fs *FolderSynchronizer) putDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return fs.ss.SetField(ctx, fs.getDeadLettersKey(), strings.ToLower(dl.Entry.Path), string(b))
+}
+
+// deadLetter records that entry failed with syncErr. It reports whether the
+// dead letter was stored.
+func (fs *FolderSynchronizer) deadLetter(ctx context.Context, root string, entry *StorageEntry, syncErr error) bool {
+	dl, err := fs.getDeadLetter(ctx, entry.Path)
+	if err != nil {
+		dl = &DeadLetter{Root: root}
+	}
+	dl.Entry = entry
+	dl.failed(syncErr)
+	if err := fs.putDeadLetter(ctx, dl); err != nil {
+		fs.log.WithError(err).Error("cannot store dead letter")
+		return false
+	}
+	fs.log.WithFields(logrus.Fields{
+		"Synchronizer": fs.Name(),
+		"Path":         entry.Path,
+		"Attempts":     dl.Attempts,
+	}).Warn("Entry has been dead-lettered.")
+	return true
+}
+
+func (fs *FolderSynchronizer) removeDeadLetter(ctx context.Context, path string) {
+	if _, err := fs.ss.DeleteField(ctx, fs.getDeadLettersKey(), strings.ToLower(path)); err != nil {
+		fs.log.WithError(err).Error("cannot remove dead letter")
+	}
+}
+
+// DeadLetters returns the dead letters of the synchronizer sorted by path.
+func (fs *FolderSynchronizer) DeadLetters(ctx context.Context) ([]*DeadLetter, error) {
+	vals, err := fs.ss.Fields(ctx, fs.getDeadLettersKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "DeadLetters failed")
+	}
+	var dls []*DeadLetter
+	for _, val := range vals {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(val), &dl); err != nil {
+			return nil, errors.Wrap(err, "DeadLetters failed")
+		}
+		dls = append(dls, &dl)
+	}
+	sort.Slice(dls, func(i, j int) bool {
+		return dls[i].Entry.Path < dls[j].Entry.Path
+	})
+	return dls, nil
+}
+
+// RetryDeadLetter synchronizes the dead-lettered entry at path again. The
+// dead letter is removed if it succeeds.
+func (fs *FolderSynchronizer) RetryDeadLetter(ctx context.Context, path string) (*NotionPage, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	dl, err := fs.getDeadLetter(ctx, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "RetryDeadLetter failed")
+	}
+	page, err := fs.retryDeadLetter(ctx, dl)
+	return page, errors.Wrap(err, "RetryDeadLetter failed")
+}
+
+// retryDeadLetter synchronizes the entry of dl again. The dead letter is
+// removed if it succeeds, and its next retry is postponed otherwise.
+func (fs *FolderSynchronizer) retryDeadLetter(ctx context.Context, dl *DeadLetter) (*NotionPage, error) {
+	var page *NotionPage
+	var err error
+	if dl.Entry.Kind == EntryDeleted {
+		err = fs.deleteFile(ctx, dl.Entry)
+	} else {
+		// The file may have changed since it failed.
+		var entry *StorageEntry
+		entry, err = fs.cb.Provider().GetMetadata(ctx, dl.Entry.Path)
+		if err == nil {
+			if dl.Entry.ID != "" {
+				entry.ID = dl.Entry.ID
+			}
+			var cloudFile *CloudFile
+			cloudFile, err = fs.cb.Build(ctx, entry)
+			page, err = fs.syncFile(ctx, dl.Root, entry, cloudFile, err)
+		}
+	}
+	if err != nil {
+		dl.failed(err)
+		if err := fs.putDeadLetter(ctx, dl); err != nil {
+			fs.log.WithError(err).Error("cannot store dead letter")
+		}
+		return nil, err
+	}
+	return page, nil
+}
+
+// retryDeadLetters retries the dead letters of root whose backoff has
+// passed. Entries in listed have just been synchronized and are skipped.
+// Failures only postpone the next retry.
+func (fs *FolderSynchronizer) retryDeadLetters(ctx context.Context, root string, listed map[string]bool) []*NotionPage {
+	dls, err := fs.DeadLetters(ctx)
+	if err != nil {
+		fs.log.Error(err)
+		return nil
+	}
+	var pages []*NotionPage
+	now := time.Now()
+	for _, dl := range dls {
+		if dl.Root != root || listed[strings.ToLower(dl.Entry.Path)] || now.Before(dl.NextRetry) {
+			continue
+		}
+		page, err := fs.retryDeadLetter(ctx, dl)
+		if err != nil {
+			fs.log.WithFields(logrus.Fields{
+				"Synchronizer": fs.Name(),
+				"Path":         dl.Entry.Path,
+				"Attempts":     dl.Attempts,
+				"NextRetry":    dl.NextRetry,
+			}).Warn("Dead letter retry failed.")
+			continue
+		}
+		if page != nil {
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+// DiscardDeadLetter forgets the dead-lettered entry at path.
+func (fs *FolderSynchronizer) DiscardDeadLetter(ctx context.Context, path string) error {
+	ok, err := fs.ss.DeleteField(ctx, fs.getDeadLettersKey(), strings.ToLower(path))
+	if err != nil {
+		return errors.Wrap(err, "DiscardDeadLetter failed")
+	}
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// DeadLetterHandler serves the API to list, retry and discard dead letters.
+// Entries are addressed by the synchronizer and path query parameters.
+type DeadLetterHandler struct {
+	token         string
+	synchronizers map[string]*FolderSynchronizer
+	log           *logrus.Logger
+}
+
+// NewDeadLetterHandler returns a handler for the dead letters of
+// synchronizers. Requests have to carry token as bearer token.
+func NewDeadLetterHandler(token string, synchronizers []*FolderSynchronizer, log *logrus.Logger) *DeadLetterHandler {
+	dlh := &DeadLetterHandler{
+		token:         token,
+		synchronizers: make(map[string]*FolderSynchronizer),
+		log:           log,
+	}
+	for _, fs := range synchronizers {
+		dlh.synchronizers[fs.Name()] = fs
+	}
+	return dlh
+}
+
+type deadLetterResponse struct {
+	Synchronizer string `json:"synchronizer"`
+	*DeadLetter
+}
+
+func (dlh *DeadLetterHandler) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		dlh.log.Errorf("Error while writing dead letter response: %v", err)
+	}
+}
+
+func (dlh *DeadLetterHandler) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !bearerAuthorized(r, dlh.token) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// synchronizer returns the synchronizer and path of a retry or discard
+// request.
+func (dlh *DeadLetterHandler) synchronizer(w http.ResponseWriter, r *http.Request) (*FolderSynchronizer, string, bool) {
+	fs, ok := dlh.synchronizers[r.URL.Query().Get("synchronizer")]
+	path := r.URL.Query().Get("path")
+	if !ok || path == "" {
+		http.Error(w, "unknown synchronizer or missing path", http.StatusBadRequest)
+		return nil, "", false
+	}
+	return fs, path, true
+}
+
+func (dlh *DeadLetterHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	resp := []deadLetterResponse{}
+	for name, fs := range dlh.synchronizers {
+		dls, err := fs.DeadLetters(r.Context())
+		if err != nil {
+			dlh.log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, dl := range dls {
+			resp = append(resp, deadLetterResponse{Synchronizer: name, DeadLetter: dl})
+		}
+	}
+	sort.SliceStable(resp, func(i, j int) bool {
+		return resp[i].Synchronizer < resp[j].Synchronizer
+	})
+	dlh.writeJSON(w, resp)
+}
+
+func (dlh *DeadLetterHandler) handleRetry(w http.ResponseWriter, r *http.Request) {
+	fs, path, ok := dlh.synchronizer(w, r)
+	if !ok {
+		return
+	}
+	page, err := fs.RetryDeadLetter(r.Context(), path)
+	if errors.Cause(err) == ErrDeadLetterNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dlh.log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	dlh.writeJSON(w, page)
+}
+
+func (dlh *DeadLetterHandler) handleDiscard(w http.ResponseWriter, r *http.Request) {
+	fs, path, ok := dlh.synchronizer(w, r)
+	if !ok {
+		return
+	}
+	err := fs.DiscardDeadLetter(r.Context(), path)
+	if err == ErrDeadLetterNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dlh.log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (dlh *DeadLetterHandler) HandleFuncs(router *mux.Router) {
+	router.HandleFunc("", dlh.authorize(dlh.handleList)).Methods("GET")
+	router.HandleFunc("/retry", dlh.authorize(dlh.handleRetry)).Methods("POST")
+	router.HandleFunc("", dlh.authorize(dlh.handleDiscard)).Methods("DELETE")
+}
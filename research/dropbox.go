@@ -1,136 +1,61 @@
 package research
 
 import (
-	"bytes"
 	"context"
 	"io"
-	"io/ioutil"
-	"path"
-	"path/filepath"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox/files"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox/sharing"
-	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"go.uber.org/multierr"
 )
 
-// DropboxSynchronizer ensures that all files inside a Dropbox folder are
-// synchronized with Notion.
-type DropboxSynchronizer struct {
-	dh   *DropboxHandler
-	cs   CloudFileSyncer
-	rdb  *redis.Client
-	log  *logrus.Logger
-	lock sync.Mutex
-}
+const dropboxProvider = "dropbox"
 
-func NewDropboxSynchronizer(dh *DropboxHandler, ch CloudFileSyncer, rdb *redis.Client, log *logrus.Logger) *DropboxSynchronizer {
-	return &DropboxSynchronizer{
-		dh:  dh,
-		cs:  ch,
-		rdb: rdb,
-		log: log,
-	}
+// DropboxLinkOptions configures the shared links of Dropbox files.
+type DropboxLinkOptions struct {
+	// PreviewOnly links files to the preview URL of their sharing metadata
+	// instead of shared links. No links are created.
+	PreviewOnly bool
+	// Visibility is the requested visibility of created links, one of
+	// "public", "team_only" and "password". The account default is used when
+	// it is empty.
+	Visibility string
+	// Password protects links with the "password" visibility.
+	Password string
+	// Expiry is how long created links are valid. Zero means forever.
+	Expiry time.Duration
 }
 
-func (ds *DropboxSynchronizer) SyncFolder(ctx context.Context, path string) ([]*NotionPage, error) {
-	ds.lock.Lock()
-	defer ds.lock.Unlock()
-
-	var cursor string
-	key := ds.getCursorKey(path)
-	if val, err := ds.rdb.Get(ctx, key).Result(); err != redis.Nil {
-		if err != nil {
-			return nil, errors.Wrap(err, "dropbox SyncFolder failed")
-		}
-		cursor = val
-		ds.log.WithFields(logrus.Fields{
-			"path":   path,
-			"cursor": cursor,
-		}).Info("Cursor has been retrieved from redis.")
-	}
-
-	entries, newCursor, err := ds.dh.ListFolder(path, cursor)
-	if err != nil {
-		if _, err := ds.rdb.Del(ctx, key).Result(); err != nil {
-			ds.log.WithError(err).Error("cannot delete dropbox cursor")
-		} else {
-			ds.log.WithFields(logrus.Fields{
-				"path":   path,
-				"cursor": cursor,
-			}).Info("Cursor has been deleted from redis.")
-		}
-		return nil, errors.Wrap(err, "dropbox SyncFolder failed")
-	}
-
-	var errs error
-	var pages []*NotionPage
-	haveErr := false
-	for _, entry := range entries {
-		switch v := entry.(type) {
-		case *files.FileMetadata:
-			ds.log.WithFields(logrus.Fields{
-				"Path": v.PathDisplay,
-				"ID":   v.Id,
-			}).Info("Dropbox file")
-			cloudFile, err := ds.dh.getCloudFile(v)
-			if err != nil {
-				ds.log.Error(err)
-				haveErr = true
-				continue
-			}
-			page, err := ds.cs.Sync(ctx, cloudFile)
-			if err != nil {
-				ds.log.WithField("CloudFile", cloudFile).Error(err)
-				haveErr = true
-				errs = multierr.Append(errs, err)
-			} else {
-				pages = append(pages, page)
-			}
-		case *files.FolderMetadata:
-			ds.log.WithFields(logrus.Fields{
-				"Path": v.PathDisplay,
-				"ID":   v.Id,
-			}).Info("Dropbox folder")
-		case *files.DeletedMetadata:
-			ds.log.WithFields(logrus.Fields{
-				"Path": v.PathDisplay,
-			}).Info("Dropbox deleted")
+func (o DropboxLinkOptions) Validate() error {
+	switch o.Visibility {
+	case "", sharing.RequestedVisibilityPublic, sharing.RequestedVisibilityTeamOnly:
+	case sharing.RequestedVisibilityPassword:
+		if o.Password == "" {
+			return errors.New("password visibility requires a link password")
 		}
+	default:
+		return errors.Errorf("invalid link visibility %q", o.Visibility)
 	}
-
-	if !haveErr && newCursor != cursor {
-		err := ds.rdb.Set(ctx, key, newCursor, 0).Err()
-		if err != nil {
-			errs = multierr.Append(errs, err)
-			return pages, errs
-		}
-		ds.log.WithFields(logrus.Fields{
-			"path":   path,
-			"cursor": newCursor,
-		}).Info("New cursor saved.")
+	if o.Expiry < 0 {
+		return errors.New("link expiry must not be negative")
 	}
-	return pages, errs
-}
-
-func (ds *DropboxSynchronizer) getCursorKey(path string) string {
-	return "cursor-dropbox-" + path
+	return nil
 }
 
-// DropboxHandler handles Dropbox API.
+// DropboxHandler handles Dropbox API. It is the Dropbox StorageProvider.
 type DropboxHandler struct {
 	config dropbox.Config
 	fc     files.Client
 	sc     sharing.Client
+	links  DropboxLinkOptions
 	log    *logrus.Logger
 }
 
-func NewDropboxHandler(token string, log *logrus.Logger) *DropboxHandler {
+func NewDropboxHandler(token string, links DropboxLinkOptions, log *logrus.Logger) *DropboxHandler {
 	config := dropbox.Config{
 		Token:    token,
 		LogLevel: dropbox.LogInfo,
@@ -142,98 +67,265 @@ func NewDropboxHandler(token string, log *logrus.Logger) *DropboxHandler {
 		config: config,
 		fc:     filesClient,
 		sc:     sharingClient,
+		links:  links,
 		log:    log,
 	}
 }
 
-func (dh *DropboxHandler) getCloudFile(fileMetadata *files.FileMetadata) (*CloudFile, error) {
-	link, err := dh.getFileLink(fileMetadata)
-	if err != nil {
-		return nil, errors.Wrap(err, "dropbox getCloudFile failed")
-	}
-	title := dh.getFileTitle(fileMetadata)
-	cloudFile := &CloudFile{
-		FileID:   fileMetadata.Id,
-		Title:    title,
-		URL:      link,
-		Provider: "dropbox",
+func (dh *DropboxHandler) Name() string {
+	return dropboxProvider
+}
+
+func newDropboxEntry(metadata files.IsMetadata) *StorageEntry {
+	switch v := metadata.(type) {
+	case *files.FileMetadata:
+		return &StorageEntry{
+			Kind:        EntryFile,
+			ID:          v.Id,
+			Path:        v.PathDisplay,
+			Size:        int64(v.Size),
+			Rev:         v.Rev,
+			ContentHash: v.ContentHash,
+			Modified:    v.ServerModified,
+		}
+	case *files.FolderMetadata:
+		return &StorageEntry{
+			Kind: EntryFolder,
+			ID:   v.Id,
+			Path: v.PathDisplay,
+		}
+	case *files.DeletedMetadata:
+		return &StorageEntry{
+			Kind: EntryDeleted,
+			Path: v.PathDisplay,
+		}
 	}
-	return cloudFile, nil
+	return nil
 }
 
-func (dh *DropboxHandler) ListFolder(path string, cursor string) ([]files.IsMetadata, string, error) {
-	var entries []files.IsMetadata
+func (dh *DropboxHandler) List(ctx context.Context, path string, cursor string, recursive bool) ([]*StorageEntry, string, error) {
+	var entries []*StorageEntry
 	for hasMore := true; hasMore; {
 		var err error
 		var resp *files.ListFolderResult
 		if cursor == "" {
 			arg := files.NewListFolderArg(path)
+			arg.Recursive = recursive
 			resp, err = dh.fc.ListFolder(arg)
 		} else {
 			arg := files.NewListFolderContinueArg(cursor)
 			resp, err = dh.fc.ListFolderContinue(arg)
 		}
 		if err != nil {
-			return entries, cursor, errors.Wrap(err, "dropbox ListFolder failed")
+			return entries, cursor, errors.Wrap(err, "dropbox List failed")
+		}
+		for _, metadata := range resp.Entries {
+			if entry := newDropboxEntry(metadata); entry != nil {
+				entries = append(entries, entry)
+			}
 		}
-		entries = append(entries, resp.Entries...)
 		cursor = resp.Cursor
 		hasMore = resp.HasMore
 	}
 	return entries, cursor, nil
 }
 
-func (dh *DropboxHandler) Upload(path string, content io.Reader) (*CloudFile, error) {
-	metadata, err := dh.fc.Upload(files.NewCommitInfo(path), content)
+func (dh *DropboxHandler) GetMetadata(ctx context.Context, path string) (*StorageEntry, error) {
+	metadata, err := dh.fc.GetMetadata(files.NewGetMetadataArg(path))
 	if err != nil {
-		return nil, errors.Wrap(err, "dropbox Upload failed")
+		return nil, errors.Wrap(err, "dropbox GetMetadata failed")
+	}
+	entry := newDropboxEntry(metadata)
+	if entry == nil {
+		return nil, errors.Errorf("dropbox GetMetadata: unexpected metadata %T", metadata)
 	}
-	return dh.getCloudFile(metadata)
+	return entry, nil
 }
 
-func (dh *DropboxHandler) getFileTitle(fileMetadata *files.FileMetadata) string {
-	getBasicTitle := func() string {
-		basename := path.Base(fileMetadata.PathDisplay)
-		ext := filepath.Ext(basename)
-		return strings.TrimSuffix(basename, ext)
+func (dh *DropboxHandler) Download(ctx context.Context, entry *StorageEntry) (io.ReadCloser, error) {
+	_, reader, err := dh.fc.Download(files.NewDownloadArg(entry.ID))
+	if err != nil {
+		return nil, errors.Wrap(err, "dropbox Download failed")
 	}
-	getPDFTitle := func() (string, error) {
-		downloadFileArg := files.NewDownloadArg(fileMetadata.PathLower)
-		_, reader, err := dh.fc.Download(downloadFileArg)
-		if err != nil {
-			return "", err
-		}
-		defer func() {
-			if err := reader.Close(); err != nil {
-				dh.log.Error(err)
-			}
-		}()
+	return reader, nil
+}
 
-		body, err := ioutil.ReadAll(reader)
-		if err != nil {
-			return "", err
-		}
-		rs := bytes.NewReader(body)
-		return GetPDFTitleFromReadSeeker(rs)
+func (dh *DropboxHandler) Upload(ctx context.Context, path string, content io.Reader) (*StorageEntry, error) {
+	// An existing file is kept, and the upload gets a name like "a (1).pdf".
+	arg := files.NewCommitInfo(path)
+	arg.Autorename = true
+	metadata, err := dh.fc.Upload(arg, content)
+	if err != nil {
+		return nil, errors.Wrap(err, "dropbox Upload failed")
 	}
+	return newDropboxEntry(metadata), nil
+}
 
-	title := getBasicTitle()
-	if IsPDF(fileMetadata.PathLower) {
-		pdfTitle, err := getPDFTitle()
-		if err == nil {
-			title = pdfTitle
+// ShareLink returns the shared link of the file. An existing link is reused,
+// otherwise a link is created.
+func (dh *DropboxHandler) ShareLink(ctx context.Context, entry *StorageEntry) (string, error) {
+	if dh.links.PreviewOnly {
+		return dh.previewLink(entry)
+	}
+
+	res, err := dh.sc.ListSharedLinks(&sharing.ListSharedLinksArg{
+		Path:       entry.ID,
+		DirectOnly: true,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "dropbox ShareLink failed")
+	}
+	for _, link := range res.Links {
+		if url := validLinkURL(link); url != "" {
+			return url, nil
 		}
 	}
-	return title
+	url, err := dh.createLink(entry)
+	if err != nil {
+		return "", errors.Wrap(err, "dropbox ShareLink failed")
+	}
+	return url, nil
 }
 
-func (dh *DropboxHandler) getFileLink(fileMetadata *files.FileMetadata) (string, error) {
-	// TODO: Use batch API
-	arg := sharing.NewGetFileMetadataArg(fileMetadata.PathLower)
+func (dh *DropboxHandler) previewLink(entry *StorageEntry) (string, error) {
+	arg := sharing.NewGetFileMetadataArg(entry.ID)
 	sharedFileMetadata, err := dh.sc.GetFileMetadata(arg)
 	if err != nil {
-		return "", errors.Wrap(err, "dropbox getFileLink failed")
+		return "", errors.Wrap(err, "dropbox ShareLink failed")
 	}
 	link := strings.TrimSuffix(sharedFileMetadata.PreviewUrl, "?dl=0")
 	return link, nil
 }
+
+func (dh *DropboxHandler) createLink(entry *StorageEntry) (string, error) {
+	settings := sharing.NewSharedLinkSettings()
+	if dh.links.Visibility != "" {
+		settings.RequestedVisibility = &sharing.RequestedVisibility{
+			Tagged: dropbox.Tagged{Tag: dh.links.Visibility},
+		}
+		if dh.links.Visibility == sharing.RequestedVisibilityPassword {
+			settings.RequirePassword = true
+			settings.LinkPassword = dh.links.Password
+		}
+	}
+	if dh.links.Expiry > 0 {
+		expires := time.Now().Add(dh.links.Expiry).UTC().Truncate(time.Second)
+		settings.Expires = &expires
+	}
+	arg := sharing.NewCreateSharedLinkWithSettingsArg(entry.ID)
+	arg.Settings = settings
+
+	link, err := dh.sc.CreateSharedLinkWithSettings(arg)
+	if apiErr, ok := err.(sharing.CreateSharedLinkWithSettingsAPIError); ok {
+		// The link was created concurrently, or the file has a link with
+		// other settings.
+		if e := apiErr.EndpointError; e != nil && e.Tag == sharing.CreateSharedLinkWithSettingsErrorSharedLinkAlreadyExists &&
+			e.SharedLinkAlreadyExists != nil && e.SharedLinkAlreadyExists.Metadata != nil {
+			link, err = e.SharedLinkAlreadyExists.Metadata, nil
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	dh.log.WithFields(logrus.Fields{
+		"Path": entry.Path,
+		"ID":   entry.ID,
+	}).Info("Shared link has been created.")
+	return linkURL(link), nil
+}
+
+func sharedLinkMetadata(link sharing.IsSharedLinkMetadata) *sharing.SharedLinkMetadata {
+	switch v := link.(type) {
+	case *sharing.FileLinkMetadata:
+		return &v.SharedLinkMetadata
+	case *sharing.FolderLinkMetadata:
+		return &v.SharedLinkMetadata
+	case *sharing.SharedLinkMetadata:
+		return v
+	}
+	return nil
+}
+
+func linkURL(link sharing.IsSharedLinkMetadata) string {
+	if metadata := sharedLinkMetadata(link); metadata != nil {
+		return metadata.Url
+	}
+	return ""
+}
+
+// validLinkURL returns the URL of link, or "" if it has expired.
+func validLinkURL(link sharing.IsSharedLinkMetadata) string {
+	metadata := sharedLinkMetadata(link)
+	if metadata == nil || (metadata.Expires != nil && metadata.Expires.Before(time.Now())) {
+		return ""
+	}
+	return metadata.Url
+}
+
+// ShareLinks looks up the existing links of entries with
+// GetFileMetadataBatch, and creates links for the files that have none unless
+// only preview links are used. Files whose link could not be looked up or
+// created are left out of the result.
+func (dh *DropboxHandler) ShareLinks(ctx context.Context, entries []*StorageEntry) (map[string]string, error) {
+	links, err := dh.lookupLinks(entries)
+	if err != nil || dh.links.PreviewOnly {
+		return links, err
+	}
+	for _, entry := range entries {
+		if _, ok := links[entry.ID]; ok {
+			continue
+		}
+		url, err := dh.createLink(entry)
+		if err != nil {
+			dh.log.WithField("Path", entry.Path).Warn(err)
+			continue
+		}
+		links[entry.ID] = url
+	}
+	return links, nil
+}
+
+// FindShareLinks returns the existing links of entries.
+func (dh *DropboxHandler) FindShareLinks(ctx context.Context, entries []*StorageEntry) (map[string]string, error) {
+	return dh.lookupLinks(entries)
+}
+
+// maxFileMetadataBatch is the maximum number of files per
+// GetFileMetadataBatch call.
+const maxFileMetadataBatch = 100
+
+// lookupLinks returns the preview links of entries, or their existing shared
+// links unless only preview links are used. No links are created.
+func (dh *DropboxHandler) lookupLinks(entries []*StorageEntry) (map[string]string, error) {
+	links := make(map[string]string)
+	for start := 0; start < len(entries); start += maxFileMetadataBatch {
+		end := start + maxFileMetadataBatch
+		if end > len(entries) {
+			end = len(entries)
+		}
+		var files []string
+		for _, entry := range entries[start:end] {
+			files = append(files, entry.ID)
+		}
+		results, err := dh.sc.GetFileMetadataBatch(sharing.NewGetFileMetadataBatchArg(files))
+		if err != nil {
+			return links, errors.Wrap(err, "dropbox ShareLinks failed")
+		}
+		for _, result := range results {
+			if result.Result == nil || result.Result.Metadata == nil {
+				continue
+			}
+			metadata := result.Result.Metadata
+			if dh.links.PreviewOnly {
+				links[result.File] = strings.TrimSuffix(metadata.PreviewUrl, "?dl=0")
+				continue
+			}
+			link := metadata.LinkMetadata
+			if link == nil || link.Url == "" || (link.Expiry != nil && link.Expiry.Before(time.Now())) {
+				continue
+			}
+			links[result.File] = link.Url
+		}
+	}
+	return links, nil
+}
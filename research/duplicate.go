@@ -0,0 +1,210 @@
+package research
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DuplicatePolicy determines what happens to a new file whose content is
+// already in Notion under another file, e.g. a paper uploaded twice under
+// different names. Duplicates are recognized by the content hash reported by
+// the provider. When the original is deleted, its duplicates are unlinked and
+// get pages of their own when they are synchronized next.
+type DuplicatePolicy string
+
+const (
+	// DuplicatePolicyNone creates a page for every file.
+	DuplicatePolicyNone DuplicatePolicy = ""
+	// DuplicatePolicyLink maps the file to the page of the existing file. No
+	// page is created and the existing page is not changed.
+	DuplicatePolicyLink DuplicatePolicy = "link"
+	// DuplicatePolicyAlternate maps the file to the page of the existing file
+	// and lists the file in the alternates property of that page.
+	DuplicatePolicyAlternate DuplicatePolicy = "alternate"
+	// DuplicatePolicyTag creates a page for the file with TagDuplicate.
+	DuplicatePolicyTag DuplicatePolicy = "tag"
+)
+
+var TagDuplicate = "duplicate"
+
+func getAlternatesKey(pageID string) string {
+	return "alternates-" + pageID
+}
+
+// alternateLocation is how a duplicate is listed in the alternates property.
+func alternateLocation(c *CloudFile) string {
+	if c.URL != "" {
+		return c.URL
+	}
+	return c.Path
+}
+
+// findOriginal returns the page of the file that c duplicates, or an empty
+// string.
+func (cs *CloudFileSyncerImpl) findOriginal(ctx context.Context, c *CloudFile) (string, error) {
+	if cs.opts.DuplicatePolicy == DuplicatePolicyNone || c.ContentHash == "" {
+		return "", nil
+	}
+	return cs.getString(ctx, getHashIndexKey(c.keySpace(), c.ContentHash))
+}
+
+// linkDuplicate maps the duplicate c to the page of its original.
+func (cs *CloudFileSyncerImpl) linkDuplicate(ctx context.Context, c *CloudFile, pageID string) (*NotionPage, error) {
+	err := cs.ss.Apply(ctx, map[string]string{
+		c.GetDuplicateKey():   pageID,
+		c.GetContentHashKey(): c.ContentHash,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	cs.log.WithFields(logrus.Fields{
+		"FileID":    c.FileID,
+		"FileTitle": c.Title,
+		"PageID":    pageID,
+		"Policy":    cs.opts.DuplicatePolicy,
+	}).Info("Cloud file is a duplicate.")
+	page, err := cs.syncDuplicate(ctx, c, pageID)
+	if err != nil {
+		return nil, err
+	}
+	return page, cs.savePath(ctx, c)
+}
+
+// syncDuplicate updates the page of the original of c. Only the alternates
+// property is written.
+func (cs *CloudFileSyncerImpl) syncDuplicate(ctx context.Context, c *CloudFile, pageID string) (*NotionPage, error) {
+	if cs.opts.DuplicatePolicy != DuplicatePolicyAlternate {
+		return cs.nh.GetPage(ctx, pageID)
+	}
+	key := getAlternatesKey(pageID)
+	if err := cs.ss.SetField(ctx, key, c.FileID, alternateLocation(c)); err != nil {
+		return nil, err
+	}
+	return cs.writeAlternates(ctx, pageID)
+}
+
+// writeAlternates writes the locations of the duplicates of the page to its
+// alternates property.
+func (cs *CloudFileSyncerImpl) writeAlternates(ctx context.Context, pageID string) (*NotionPage, error) {
+	fields, err := cs.ss.Fields(ctx, getAlternatesKey(pageID))
+	if err != nil {
+		return nil, err
+	}
+	var locations []string
+	for _, location := range fields {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	return cs.nh.SetAlternates(ctx, pageID, locations)
+}
+
+// unlinkDuplicate removes the mapping of the duplicate c to the page of its
+// original, and removes c from the alternates of that page.
+func (cs *CloudFileSyncerImpl) unlinkDuplicate(ctx context.Context, c *CloudFile, pageID string) error {
+	ok, err := cs.ss.DeleteField(ctx, getAlternatesKey(pageID), c.FileID)
+	if err != nil {
+		return err
+	}
+	if ok && cs.nh.props.Alternates != "" {
+		if _, err := cs.writeAlternates(ctx, pageID); err != nil {
+			return err
+		}
+	}
+	return cs.ss.Delete(ctx, c.GetDuplicateKey(), c.GetContentHashKey())
+}
+
+// deleteDuplicate forgets the deleted duplicate c. The page of its original
+// is kept.
+func (cs *CloudFileSyncerImpl) deleteDuplicate(ctx context.Context, c *CloudFile, pageID string) error {
+	if err := cs.unlinkDuplicate(ctx, c, pageID); err != nil {
+		return err
+	}
+	cs.log.WithFields(logrus.Fields{
+		"FileID": c.FileID,
+		"Path":   c.Path,
+		"PageID": pageID,
+	}).Info("Deleted duplicate forgotten.")
+	return cs.ss.Delete(ctx, c.GetPathKey(), c.GetLastPathKey())
+}
+
+// unlinkDuplicates removes the mappings of the duplicates of the deleted file
+// c to its page, which is deleted along with c, so that each of them gets a
+// page of its own when it is synchronized next.
+func (cs *CloudFileSyncerImpl) unlinkDuplicates(ctx context.Context, c *CloudFile, pageID string) error {
+	prefix := CloudFile{Provider: c.Provider, Namespace: c.Namespace}.GetDuplicateKey()
+	keys, err := cs.ss.Keys(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	del := []string{getAlternatesKey(pageID)}
+	for _, key := range keys {
+		originalID, err := cs.getString(ctx, key)
+		if err != nil {
+			return err
+		}
+		if originalID != pageID {
+			continue
+		}
+		duplicate := CloudFile{
+			Provider:  c.Provider,
+			Namespace: c.Namespace,
+			FileID:    strings.TrimPrefix(key, prefix),
+		}
+		del = append(del, key, duplicate.GetContentHashKey())
+		cs.log.WithFields(logrus.Fields{
+			"FileID": duplicate.FileID,
+			"PageID": pageID,
+		}).Info("Duplicate of deleted file unlinked.")
+	}
+	return cs.ss.Delete(ctx, del...)
+}
+
+// saveContentHash records the content hash of c, and indexes it if no other
+// page has the same content. The index entry of the previous content of the
+// file is removed.
+func (cs *CloudFileSyncerImpl) saveContentHash(ctx context.Context, c *CloudFile, pageID string) error {
+	lastHash, err := cs.getString(ctx, c.GetContentHashKey())
+	if err != nil {
+		return err
+	}
+	if lastHash == c.ContentHash {
+		return nil
+	}
+	if err := cs.unindexContentHash(ctx, c.keySpace(), lastHash, pageID); err != nil {
+		return err
+	}
+	if c.ContentHash == "" {
+		return cs.ss.Delete(ctx, c.GetContentHashKey())
+	}
+	set := map[string]string{
+		c.GetContentHashKey(): c.ContentHash,
+	}
+	indexKey := getHashIndexKey(c.keySpace(), c.ContentHash)
+	original, err := cs.getString(ctx, indexKey)
+	if err != nil {
+		return err
+	}
+	if original == "" {
+		set[indexKey] = pageID
+	}
+	return cs.ss.Apply(ctx, set, nil)
+}
+
+// unindexContentHash removes the index entry of hash if it points to pageID.
+func (cs *CloudFileSyncerImpl) unindexContentHash(ctx context.Context, keySpace string, hash string, pageID string) error {
+	if hash == "" {
+		return nil
+	}
+	indexKey := getHashIndexKey(keySpace, hash)
+	indexed, err := cs.getString(ctx, indexKey)
+	if err != nil {
+		return err
+	}
+	if indexed != pageID {
+		return nil
+	}
+	return cs.ss.Delete(ctx, indexKey)
+}
@@ -0,0 +1,96 @@
+package research
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeNotion answers the requests of a NotionHandler. Created pages are
+// numbered, queries find no page and updates return the updated page.
+type fakeNotion struct {
+	lock     sync.Mutex
+	created  int
+	requests []string
+}
+
+func (fn *fakeNotion) RoundTrip(req *http.Request) (*http.Response, error) {
+	fn.lock.Lock()
+	defer fn.lock.Unlock()
+	fn.requests = append(fn.requests, req.Method+" "+req.URL.Path)
+
+	body := `{"object": "list", "results": [], "has_more": false}`
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/v1/pages":
+		fn.created++
+		body = fmt.Sprintf(`{"object": "page", "id": "page-%d", "properties": {}}`, fn.created)
+	case strings.HasPrefix(req.URL.Path, "/v1/pages/"):
+		body = fmt.Sprintf(`{"object": "page", "id": %q, "properties": {}}`, strings.TrimPrefix(req.URL.Path, "/v1/pages/"))
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func (fn *fakeNotion) takeRequests() []string {
+	fn.lock.Lock()
+	defer fn.lock.Unlock()
+	requests := fn.requests
+	fn.requests = nil
+	return requests
+}
+
+func TestDeleteOriginalUnlinksDuplicates(t *testing.T) {
+	fn := &fakeNotion{}
+	nh := NewNotionHandler("token", "database", NotionProperties{Alternates: "Alternates"}, &http.Client{Transport: fn})
+	ss := NewMemoryStateStore()
+	cs := NewCloudFileSyncerImpl(nh, ss, newTestLogger(), SyncOptions{
+		DeletePolicy:    DeletePolicyArchive,
+		DuplicatePolicy: DuplicatePolicyAlternate,
+	})
+	ctx := context.Background()
+
+	original := &CloudFile{Provider: "local", FileID: "1", Path: "/a.pdf", Title: "a", ContentHash: "hash"}
+	duplicate := &CloudFile{Provider: "local", FileID: "2", Path: "/b.pdf", Title: "b", ContentHash: "hash"}
+	page, err := cs.Sync(ctx, original)
+	if err != nil || page.ID != "page-1" {
+		t.Fatalf("Sync of the original = %+v, %v, want page-1", page, err)
+	}
+	if _, err := cs.Sync(ctx, duplicate); err != nil {
+		t.Fatalf("Sync of the duplicate failed: %v", err)
+	}
+	if pageID, _ := ss.Get(ctx, duplicate.GetDuplicateKey()); pageID != "page-1" {
+		t.Fatalf("duplicate is mapped to %q, want page-1", pageID)
+	}
+	fn.takeRequests()
+
+	if err := cs.Delete(ctx, &CloudFile{Provider: "local", Path: "/a.pdf"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if requests := fn.takeRequests(); len(requests) != 1 || requests[0] != "PATCH /v1/pages/page-1" {
+		t.Errorf("Delete sent %v, want only the archiving of page-1", requests)
+	}
+	for _, key := range []string{duplicate.GetDuplicateKey(), duplicate.GetContentHashKey(), getHashIndexKey("local", "hash")} {
+		if _, err := ss.Get(ctx, key); err != ErrStateNotFound {
+			t.Errorf("%s has not been deleted: %v", key, err)
+		}
+	}
+	if fields, _ := ss.Fields(ctx, getAlternatesKey("page-1")); len(fields) != 0 {
+		t.Errorf("alternates of the deleted page = %v, want none", fields)
+	}
+
+	page, err = cs.Sync(ctx, duplicate)
+	if err != nil || page.ID != "page-2" {
+		t.Fatalf("Sync of the former duplicate = %+v, %v, want a new page-2", page, err)
+	}
+	if pageID, _ := ss.Get(ctx, getHashIndexKey("local", "hash")); pageID != "page-2" {
+		t.Errorf("content hash is indexed to %q, want page-2", pageID)
+	}
+}
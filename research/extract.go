@@ -0,0 +1,264 @@
+package research
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+var ErrFileTooLarge = errors.New("file is too large for extraction")
+
+// tempFile is a temporary file that is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (tf tempFile) Close() error {
+	err := tf.File.Close()
+	if rmErr := os.Remove(tf.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// DownloadToTemp copies r to a temporary file and returns the number of bytes
+// copied. It fails with ErrFileTooLarge if r is larger than maxSize bytes,
+// unless maxSize is zero. The file is removed when it is closed.
+func DownloadToTemp(r io.Reader, maxSize int64) (io.ReadSeekCloser, int64, error) {
+	f, err := ioutil.TempFile("", "notionify-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	tf := tempFile{f}
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	n, err := io.Copy(tf, r)
+	if err == nil && maxSize > 0 && n > maxSize {
+		err = ErrFileTooLarge
+	}
+	if err != nil {
+		tf.Close()
+		return nil, n, err
+	}
+	return tf, n, nil
+}
+
+// ExtractionStats is the cost of the downloads done for extraction.
+type ExtractionStats struct {
+	Downloads int64
+	Skipped   int64
+	Bytes     int64
+	Duration  time.Duration
+}
+
+// extractionCounter records ExtractionStats concurrently.
+type extractionCounter struct {
+	downloads int64
+	skipped   int64
+	bytes     int64
+	duration  int64
+}
+
+func (ec *extractionCounter) addDownload(n int64, d time.Duration) {
+	atomic.AddInt64(&ec.downloads, 1)
+	atomic.AddInt64(&ec.bytes, n)
+	atomic.AddInt64(&ec.duration, int64(d))
+}
+
+func (ec *extractionCounter) addSkipped() {
+	atomic.AddInt64(&ec.skipped, 1)
+}
+
+func (ec *extractionCounter) stats() ExtractionStats {
+	return ExtractionStats{
+		Downloads: atomic.LoadInt64(&ec.downloads),
+		Skipped:   atomic.LoadInt64(&ec.skipped),
+		Bytes:     atomic.LoadInt64(&ec.bytes),
+		Duration:  time.Duration(atomic.LoadInt64(&ec.duration)),
+	}
+}
+
+// Source gives extractors access to a cloud file. Its content is only
+// fetched when an extractor asks for it, and at most once.
+type Source struct {
+	Path string
+
+	open    func() (io.ReadSeeker, error)
+	content io.ReadSeeker
+	err     error
+	opened  bool
+}
+
+func NewSource(path string, open func() (io.ReadSeeker, error)) *Source {
+	return &Source{
+		Path: path,
+		open: open,
+	}
+}
+
+// Content returns the content of the file, positioned at its beginning.
+func (s *Source) Content() (io.ReadSeeker, error) {
+	if !s.opened {
+		s.opened = true
+		s.content, s.err = s.open()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	if _, err := s.content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.content, nil
+}
+
+// Close releases the content of the file if it has been fetched.
+func (s *Source) Close() error {
+	if closer, ok := s.content.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Extractor fills in the metadata of a CloudFile. Extractors overwrite the
+// fields they find and leave the others untouched.
+type Extractor interface {
+	Extract(ctx context.Context, src *Source, c *CloudFile) error
+}
+
+type chainEntry struct {
+	exts      []string
+	extractor Extractor
+}
+
+// ExtractorChain runs the extractors registered for the type of a file in
+// registration order, so later extractors take precedence.
+type ExtractorChain struct {
+	entries []chainEntry
+}
+
+func NewExtractorChain() *ExtractorChain {
+	return &ExtractorChain{}
+}
+
+// DefaultExtractorChain takes the title from the file name, and the document
+// information from PDF files.
+func DefaultExtractorChain() *ExtractorChain {
+	ec := NewExtractorChain()
+	ec.Register(FilenameExtractor{})
+	ec.Register(PDFInfoExtractor{}, ".pdf")
+	return ec
+}
+
+// Register adds e for files with one of the given extensions, or for all
+// files if no extension is given.
+func (ec *ExtractorChain) Register(e Extractor, exts ...string) {
+	var lowered []string
+	for _, ext := range exts {
+		lowered = append(lowered, strings.ToLower(ext))
+	}
+	ec.entries = append(ec.entries, chainEntry{exts: lowered, extractor: e})
+}
+
+// Extract runs the extractors on src. A failing extractor does not stop the
+// others, their errors are combined.
+func (ec *ExtractorChain) Extract(ctx context.Context, src *Source, c *CloudFile) error {
+	ext := strings.ToLower(filepath.Ext(src.Path))
+	var errs error
+	for _, entry := range ec.entries {
+		if len(entry.exts) > 0 && !containsString(entry.exts, ext) {
+			continue
+		}
+		if err := entry.extractor.Extract(ctx, src, c); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// FilenameExtractor uses the file name without its extension as title.
+type FilenameExtractor struct{}
+
+func (FilenameExtractor) Extract(ctx context.Context, src *Source, c *CloudFile) error {
+	basename := path.Base(src.Path)
+	c.Title = strings.TrimSuffix(basename, filepath.Ext(basename))
+	return nil
+}
+
+// PDFInfoExtractor reads the document information dictionary of PDF files.
+type PDFInfoExtractor struct{}
+
+func (PDFInfoExtractor) Extract(ctx context.Context, src *Source, c *CloudFile) error {
+	rs, err := src.Content()
+	if err != nil {
+		return errors.Wrap(err, "pdf info extraction failed")
+	}
+	info, err := GetPDFInfoFromReadSeeker(rs)
+	if err != nil {
+		return errors.Wrap(err, "pdf info extraction failed")
+	}
+	if info.Title != "" {
+		c.Title = info.Title
+	}
+	if authors := splitAuthors(info.Author); len(authors) > 0 {
+		c.Authors = authors
+	}
+	if year := info.Year(); year != 0 {
+		c.Year = year
+	}
+	if info.Subject != "" {
+		c.Abstract = info.Subject
+	}
+	if len(info.Keywords) > 0 {
+		c.Keywords = splitKeywords(info.Keywords)
+	}
+	if info.PageCount > 0 {
+		c.PageCount = info.PageCount
+	}
+	return nil
+}
+
+var authorSeparator = regexp.MustCompile(`\s*(?:;|\band\b|&)\s*`)
+
+// splitAuthors splits an author list separated by semicolons, "and" or
+// ampersands. Commas are ambiguous ("Doe, John") and are only used when no
+// other separator is present.
+func splitAuthors(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	parts := authorSeparator.Split(s, -1)
+	if len(parts) == 1 {
+		parts = strings.Split(s, ",")
+	}
+	var authors []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(strings.Trim(part, ",")); part != "" {
+			authors = append(authors, part)
+		}
+	}
+	return authors
+}
+
+func splitKeywords(lines []string) []string {
+	var keywords []string
+	for _, line := range lines {
+		for _, keyword := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ';' }) {
+			if keyword = strings.TrimSpace(keyword); keyword != "" && !containsString(keywords, keyword) {
+				keywords = append(keywords, keyword)
+			}
+		}
+	}
+	return keywords
+}
@@ -0,0 +1,73 @@
+package research
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FolderPropertyType is the type of the Notion property that folders are
+// mapped to.
+type FolderPropertyType string
+
+const (
+	// FolderPropertyMultiSelect adds an option for every mapped folder.
+	FolderPropertyMultiSelect FolderPropertyType = "multi_select"
+	// FolderPropertySelect selects the deepest mapped folder.
+	FolderPropertySelect FolderPropertyType = "select"
+	// FolderPropertyRelation would relate the page to a page per folder.
+	// The Notion client cannot decode relation values, so it is rejected.
+	FolderPropertyRelation FolderPropertyType = "relation"
+)
+
+// FolderMapping maps the folders of a file to the values of a Notion
+// property. For example, with a root folder of /Papers, the file
+// /Papers/ML/Transformers/attention.pdf has the folders ML and Transformers.
+type FolderMapping struct {
+	Property string
+	Type     FolderPropertyType
+	// Values maps lowercased folder names to option names. Folders that are
+	// not in Values keep their own name, unless OnlyMapped is set, in which
+	// case they are ignored.
+	Values     map[string]string
+	OnlyMapped bool
+}
+
+func (m FolderMapping) Enabled() bool {
+	return m.Property != ""
+}
+
+func (m FolderMapping) Validate() error {
+	if !m.Enabled() {
+		return nil
+	}
+	switch m.Type {
+	case FolderPropertyMultiSelect, FolderPropertySelect:
+		return nil
+	case FolderPropertyRelation:
+		return errors.New("folder mapping: relation properties are not supported by the Notion client")
+	default:
+		return errors.Errorf("folder mapping: unknown property type %q", m.Type)
+	}
+}
+
+// Map returns the property values of the given folders.
+func (m FolderMapping) Map(folders []string) []string {
+	var values []string
+	for _, folder := range folders {
+		value, ok := m.Values[strings.ToLower(folder)]
+		if !ok {
+			if m.OnlyMapped {
+				continue
+			}
+			value = folder
+		}
+		if value != "" && !containsString(values, value) {
+			values = append(values, value)
+		}
+	}
+	if m.Type == FolderPropertySelect && len(values) > 1 {
+		values = values[len(values)-1:]
+	}
+	return values
+}
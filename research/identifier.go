@@ -0,0 +1,177 @@
+package research
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pkg/errors"
+)
+
+var (
+	doiPattern      = regexp.MustCompile(`\b(10\.\d{4,9}/[-._;()/:A-Za-z0-9]+)`)
+	arXivPattern    = regexp.MustCompile(`(?i)\barXiv:\s*(\d{4}\.\d{4,5}|[a-z-]+(?:\.[A-Z]{2})?/\d{7})(v\d+)?`)
+	arXivURLPattern = regexp.MustCompile(`(?i)arxiv\.org/(?:abs|pdf)/(\d{4}\.\d{4,5}|[a-z-]+(?:\.[A-Z]{2})?/\d{7})(v\d+)?`)
+)
+
+// FindDOI returns the first DOI in text.
+func FindDOI(text string) string {
+	m := doiPattern.FindStringSubmatch(text)
+	if m == nil {
+		return ""
+	}
+	return NormalizeDOI(m[1])
+}
+
+// FindArXivID returns the first arXiv identifier in text, without version.
+func FindArXivID(text string) string {
+	for _, pattern := range []*regexp.Regexp{arXivPattern, arXivURLPattern} {
+		if m := pattern.FindStringSubmatch(text); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// NormalizeDOI lowercases doi and removes trailing punctuation that is
+// usually part of the surrounding text.
+func NormalizeDOI(doi string) string {
+	doi = strings.TrimSpace(doi)
+	doi = strings.TrimPrefix(doi, "https://doi.org/")
+	doi = strings.TrimPrefix(doi, "doi:")
+	return strings.ToLower(strings.TrimRight(doi, ".,;:)"))
+}
+
+// IdentifierExtractor scans the text of the first pages of a PDF file for a
+// DOI and an arXiv identifier.
+type IdentifierExtractor struct {
+	pages int
+}
+
+func NewIdentifierExtractor(pages int) *IdentifierExtractor {
+	if pages <= 0 {
+		pages = 2
+	}
+	return &IdentifierExtractor{pages: pages}
+}
+
+func (ie *IdentifierExtractor) Extract(ctx context.Context, src *Source, c *CloudFile) error {
+	rs, err := src.Content()
+	if err != nil {
+		return errors.Wrap(err, "identifier extraction failed")
+	}
+	pdfCtx, err := pdfcpu.ReadContext(rs, nil)
+	if err != nil {
+		return errors.Wrap(err, "identifier extraction failed")
+	}
+	if err := pdfcpu.ValidateContext(pdfCtx); err != nil {
+		return errors.Wrap(err, "identifier extraction failed")
+	}
+	if err := pdfCtx.EnsurePageCount(); err != nil {
+		return errors.Wrap(err, "identifier extraction failed")
+	}
+
+	var text strings.Builder
+	for pageNr := 1; pageNr <= ie.pages && pageNr <= pdfCtx.PageCount; pageNr++ {
+		r, err := pdfCtx.ExtractPageContent(pageNr)
+		if err != nil {
+			return errors.Wrap(err, "identifier extraction failed")
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return errors.Wrap(err, "identifier extraction failed")
+		}
+		text.WriteString(contentText(content))
+		text.WriteString("\n")
+	}
+
+	if doi := FindDOI(text.String()); doi != "" {
+		c.DOI = doi
+	}
+	if id := FindArXivID(text.String()); id != "" {
+		c.ArXivID = id
+	}
+	return nil
+}
+
+// contentText returns the literal strings shown by a page content stream.
+// Strings of a TJ array are joined, unless they are separated by a large
+// negative offset which usually stands for a space. This is only meant to be
+// good enough to find identifiers.
+func contentText(content []byte) string {
+	var text bytes.Buffer
+	inArray := false
+	for i := 0; i < len(content); i++ {
+		switch ch := content[i]; ch {
+		case '(':
+			var s []byte
+			s, i = readLiteralString(content, i)
+			text.Write(s)
+			if !inArray {
+				text.WriteByte(' ')
+			}
+		case '[':
+			inArray = true
+		case ']':
+			inArray = false
+			text.WriteByte(' ')
+		case '-':
+			if inArray {
+				j := i + 1
+				for j < len(content) && (content[j] >= '0' && content[j] <= '9' || content[j] == '.') {
+					j++
+				}
+				if j-i > 3 {
+					text.WriteByte(' ')
+				}
+				i = j - 1
+			}
+		}
+	}
+	return text.String()
+}
+
+// readLiteralString reads the literal string that starts at content[start]
+// and returns it together with the index of its closing parenthesis.
+func readLiteralString(content []byte, start int) ([]byte, int) {
+	var s []byte
+	depth := 0
+	for i := start; i < len(content); i++ {
+		ch := content[i]
+		switch {
+		case ch == '\\' && i+1 < len(content):
+			i++
+			switch next := content[i]; next {
+			case 'n', 'r', 't':
+				s = append(s, ' ')
+			case '\n', '\r':
+			default:
+				if next >= '0' && next <= '7' {
+					// Octal escapes are mostly glyph codes, skip them.
+					for j := 0; j < 2 && i+1 < len(content) && content[i+1] >= '0' && content[i+1] <= '7'; j++ {
+						i++
+					}
+					continue
+				}
+				s = append(s, next)
+			}
+		case ch == '(':
+			if depth > 0 {
+				s = append(s, ch)
+			}
+			depth++
+		case ch == ')':
+			depth--
+			if depth == 0 {
+				return s, i
+			}
+			s = append(s, ch)
+		default:
+			s = append(s, ch)
+		}
+	}
+	return s, len(content)
+}
@@ -0,0 +1,61 @@
+package research
+
+import "testing"
+
+func TestFindDOI(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"doi:10.1145/3292500.3330701.", "10.1145/3292500.3330701"},
+		{"(see https://doi.org/10.1000/XYZ-123),", "10.1000/xyz-123"},
+		{"DOI 10.1234/abc; accepted", "10.1234/abc"},
+		{"published as 10.1002/(SICI)1097-4571(199806)49:8<693::AID-ASI4>3.0.CO;2-0", "10.1002/(sici)1097-4571(199806)49:8"},
+		{"version 10.12/abc", ""},
+		{"no identifier", ""},
+	}
+	for _, tt := range tests {
+		if got := FindDOI(tt.text); got != tt.want {
+			t.Errorf("FindDOI(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestFindArXivID(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"arXiv:1706.03762v5 [cs.CL] 6 Dec 2017", "1706.03762"},
+		{"Preprint arXiv: 2101.00001", "2101.00001"},
+		{"ARXIV:0704.0001", "0704.0001"},
+		{"arXiv:hep-th/9901001v2", "hep-th/9901001"},
+		{"arXiv:math.GT/0309136", "math.GT/0309136"},
+		{"https://arxiv.org/pdf/1706.03762v2.pdf", "1706.03762"},
+		{"https://arxiv.org/abs/cond-mat/0102536", "cond-mat/0102536"},
+		{"version 1706.03762", ""},
+	}
+	for _, tt := range tests {
+		if got := FindArXivID(tt.text); got != tt.want {
+			t.Errorf("FindArXivID(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestContentText(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"BT /F1 12 Tf (Hello) Tj ET", "Hello "},
+		{"[(ar)-20(Xiv:)-500(1706.03762)] TJ", "arXiv: 1706.03762 "},
+		{`(10.1000\(x\)/y) Tj`, "10.1000(x)/y "},
+		{"(a(b)c) Tj", "a(b)c "},
+		{`(a\101b\nc) Tj`, "ab c "},
+	}
+	for _, tt := range tests {
+		if got := contentText([]byte(tt.content)); got != tt.want {
+			t.Errorf("contentText(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
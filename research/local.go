@@ -0,0 +1,269 @@
+package research
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const localProvider = "local"
+
+// LocalProvider is a StorageProvider for a directory on the local file
+// system, e.g. a folder synchronized by a desktop client. Its paths are
+// slash separated and relative to the directory. It has no change feed, so
+// its cursor is a snapshot of the previous listing.
+type LocalProvider struct {
+	root        string
+	urlTemplate string
+}
+
+// NewLocalProvider returns a provider for the directory root. Share links are
+// built from urlTemplate by replacing {path} with the escaped path of the
+// file, and {id} with its ID, e.g. https://files.example.com/papers{path}.
+func NewLocalProvider(root string, urlTemplate string) *LocalProvider {
+	return &LocalProvider{
+		root:        root,
+		urlTemplate: urlTemplate,
+	}
+}
+
+func (lp *LocalProvider) Name() string {
+	return localProvider
+}
+
+func (lp *LocalProvider) osPath(p string) string {
+	return filepath.Join(lp.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+func (lp *LocalProvider) newEntry(p string, info os.FileInfo) *StorageEntry {
+	entry := &StorageEntry{
+		Kind:     EntryFile,
+		Path:     p,
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+		Rev:      fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano()),
+	}
+	if info.IsDir() {
+		entry.Kind = EntryFolder
+	}
+	return entry
+}
+
+// localFileID derives the ID of a file that has not been seen before from its
+// path. Moved files keep their original ID through the snapshot.
+func localFileID(entry *StorageEntry) string {
+	sum := sha1.Sum([]byte(entry.Path))
+	return hex.EncodeToString(sum[:10])
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~")
+}
+
+func (lp *LocalProvider) List(ctx context.Context, p string, cursor string, recursive bool) ([]*StorageEntry, string, error) {
+	prev, err := decodeSnapshot(cursor)
+	if err != nil {
+		return nil, cursor, errors.Wrap(err, "local List failed")
+	}
+
+	base := lp.osPath(p)
+	var listing []*StorageEntry
+	err = filepath.Walk(base, func(osPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if osPath == base {
+			return nil
+		}
+		if isHidden(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(lp.root, osPath)
+		if err != nil {
+			return err
+		}
+		listing = append(listing, lp.newEntry("/"+filepath.ToSlash(rel), info))
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, cursor, errors.Wrap(err, "local List failed")
+	}
+
+	entries, cur := diffListing(prev, listing, localFileID)
+	newCursor, err := cur.encode()
+	if err != nil {
+		return nil, cursor, errors.Wrap(err, "local List failed")
+	}
+	return entries, newCursor, nil
+}
+
+func (lp *LocalProvider) GetMetadata(ctx context.Context, p string) (*StorageEntry, error) {
+	info, err := os.Stat(lp.osPath(p))
+	if err != nil {
+		return nil, errors.Wrap(err, "local GetMetadata failed")
+	}
+	entry := lp.newEntry(path.Clean("/"+p), info)
+	entry.ID = localFileID(entry)
+	return entry, nil
+}
+
+func (lp *LocalProvider) ShareLink(ctx context.Context, entry *StorageEntry) (string, error) {
+	if lp.urlTemplate == "" {
+		return "", nil
+	}
+	segments := strings.Split(entry.Path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.NewReplacer(
+		"{path}", strings.Join(segments, "/"),
+		"{id}", url.PathEscape(entry.ID),
+	).Replace(lp.urlTemplate), nil
+}
+
+func (lp *LocalProvider) Download(ctx context.Context, entry *StorageEntry) (io.ReadCloser, error) {
+	f, err := os.Open(lp.osPath(entry.Path))
+	if err != nil {
+		return nil, errors.Wrap(err, "local Download failed")
+	}
+	return f, nil
+}
+
+func (lp *LocalProvider) Upload(ctx context.Context, p string, content io.Reader) (*StorageEntry, error) {
+	osPath := lp.osPath(p)
+	if err := os.MkdirAll(filepath.Dir(osPath), 0755); err != nil {
+		return nil, errors.Wrap(err, "local Upload failed")
+	}
+	f, err := os.Create(osPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "local Upload failed")
+	}
+	_, err = io.Copy(f, content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "local Upload failed")
+	}
+	return lp.GetMetadata(ctx, p)
+}
+
+// LocalWatcher synchronizes a folder of a LocalProvider whenever its content
+// changes. Bursts of events are coalesced into one synchronization.
+type LocalWatcher struct {
+	lp       *LocalProvider
+	fs       *FolderSynchronizer
+	path     string
+	debounce time.Duration
+	log      *logrus.Logger
+}
+
+func NewLocalWatcher(lp *LocalProvider, fs *FolderSynchronizer, path string, debounce time.Duration, log *logrus.Logger) *LocalWatcher {
+	if debounce <= 0 {
+		debounce = 2 * time.Second
+	}
+	return &LocalWatcher{
+		lp:       lp,
+		fs:       fs,
+		path:     path,
+		debounce: debounce,
+		log:      log,
+	}
+}
+
+// watchDirs adds osPath and its subdirectories to the watcher.
+func (lw *LocalWatcher) watchDirs(watcher *fsnotify.Watcher, osPath string) error {
+	return filepath.Walk(osPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if p != osPath && isHidden(info.Name()) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(p)
+	})
+}
+
+func (lw *LocalWatcher) sync(ctx context.Context) {
+	pages, err := lw.fs.SyncFolder(ctx, lw.path)
+	if err != nil {
+		lw.log.Error(err)
+		return
+	}
+	for _, page := range pages {
+		lw.log.WithFields(logrus.Fields{
+			"Name": page.Name,
+			"ID":   page.ID,
+		}).Info("Synced page")
+	}
+}
+
+// Run synchronizes the folder once, and then on every change until ctx is
+// done.
+func (lw *LocalWatcher) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "local watcher failed")
+	}
+	defer watcher.Close()
+	if err := lw.watchDirs(watcher, lw.lp.osPath(lw.path)); err != nil {
+		return errors.Wrap(err, "local watcher failed")
+	}
+
+	lw.sync(ctx)
+
+	timer := time.NewTimer(lw.debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := lw.watchDirs(watcher, event.Name); err != nil {
+						lw.log.WithError(err).Error("cannot watch directory")
+					}
+				}
+			}
+			timer.Reset(lw.debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			lw.log.WithError(err).Error("local watcher error")
+		case <-timer.C:
+			lw.sync(ctx)
+		}
+	}
+}
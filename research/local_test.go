@@ -0,0 +1,93 @@
+package research
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, root string, p string) {
+	t.Helper()
+	osPath := filepath.Join(root, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(osPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(osPath, []byte(p), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalSyncFolder(t *testing.T) {
+	root, err := ioutil.TempDir("", "notionify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeTestFile(t, root, "a.pdf")
+	writeTestFile(t, root, "sub/b.pdf")
+	writeTestFile(t, root, ".hidden.pdf")
+
+	log := newTestLogger()
+	lp := NewLocalProvider(root, "")
+	cb := NewCloudFileBuilder(lp, "", NewExtractorChain(), 0, 1, log)
+	ss := NewMemoryStateStore()
+	fs := NewFolderSynchronizer(true, 1, cb, DummyCloudFileSyncer{}, ss, log)
+	ctx := context.Background()
+
+	pages, err := fs.SyncFolder(ctx, "/")
+	if err != nil {
+		t.Fatalf("SyncFolder failed: %v", err)
+	}
+	if len(pages) != 2 {
+		t.Errorf("first SyncFolder synchronized %d files, want 2", len(pages))
+	}
+	cursor, err := ss.Get(ctx, fs.getCursorKey("/"))
+	if err != nil {
+		t.Fatalf("cursor has not been saved: %v", err)
+	}
+
+	entries, _, err := lp.List(ctx, "/", cursor, true)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("List after SyncFolder = %d entries, want none", len(entries))
+	}
+
+	pages, err = fs.SyncFolder(ctx, "/")
+	if err != nil || len(pages) != 0 {
+		t.Errorf("unchanged SyncFolder = %d pages, %v, want none", len(pages), err)
+	}
+
+	if err := os.Remove(filepath.Join(root, "a.pdf")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, root, "sub/c.pdf")
+	cursor, _ = ss.Get(ctx, fs.getCursorKey("/"))
+	entries, _, err = lp.List(ctx, "/", cursor, true)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	kinds := make(map[string]EntryKind)
+	for _, entry := range entries {
+		kinds[entry.Path] = entry.Kind
+		if entry.Kind == EntryFile && (entry.ID == "" || strings.Contains(entry.ID, ":")) {
+			t.Errorf("ID of %s = %q, want a bare ID", entry.Path, entry.ID)
+		}
+	}
+	if len(kinds) != 2 || kinds["/a.pdf"] != EntryDeleted || kinds["/sub/c.pdf"] != EntryFile {
+		t.Errorf("List after changes = %v, want /a.pdf deleted and /sub/c.pdf added", kinds)
+	}
+
+	pages, err = fs.SyncFolder(ctx, "/")
+	if err != nil || len(pages) != 1 {
+		t.Errorf("SyncFolder after changes = %d pages, %v, want 1", len(pages), err)
+	}
+	newCursor, _ := ss.Get(ctx, fs.getCursorKey("/"))
+	if newCursor == cursor {
+		t.Error("cursor has not advanced")
+	}
+}
@@ -0,0 +1,104 @@
+package research
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func (fs *FolderSynchronizer) getMigratedKey(path string) string {
+	return "migrated-" + fs.Name() + "-" + path
+}
+
+// migrateKeys moves the state of the files below path from the keys without
+// a namespace, which older versions wrote for every account, to the keys of
+// the namespace of fs. Only the files that are listed in the account are
+// moved, since the old keys of different accounts cannot be told apart
+// otherwise. It runs once per folder.
+func (fs *FolderSynchronizer) migrateKeys(ctx context.Context, path string) error {
+	namespace := fs.cb.Namespace()
+	if namespace == "" {
+		return nil
+	}
+	marker := fs.getMigratedKey(path)
+	if _, err := fs.ss.Get(ctx, marker); err != ErrStateNotFound {
+		return err
+	}
+
+	sp := fs.cb.Provider()
+	entries, _, err := sp.List(ctx, path, "", fs.recursive)
+	if err != nil {
+		return err
+	}
+	migrated := 0
+	for _, entry := range entries {
+		if entry.Kind != EntryFile {
+			continue
+		}
+		legacy := CloudFile{Provider: sp.Name(), FileID: entry.ID, Path: entry.Path}
+		c := legacy
+		c.Namespace = namespace
+		set := make(map[string]string)
+		var del []string
+		for _, keys := range [][2]string{
+			{legacy.GetKey(), c.GetKey()},
+			{legacy.GetLastPathKey(), c.GetLastPathKey()},
+			{legacy.GetLastTitleKey(), c.GetLastTitleKey()},
+			{legacy.GetLastFolderValuesKey(), c.GetLastFolderValuesKey()},
+			{legacy.GetContentHashKey(), c.GetContentHashKey()},
+			{legacy.GetDuplicateKey(), c.GetDuplicateKey()},
+		} {
+			val, err := fs.ss.Get(ctx, keys[0])
+			if err == ErrStateNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			// Keys that have been written since the upgrade are newer.
+			if _, err := fs.ss.Get(ctx, keys[1]); err == ErrStateNotFound {
+				set[keys[1]] = val
+			} else if err != nil {
+				return err
+			}
+			del = append(del, keys[0])
+		}
+		// The path index is shared by all accounts, so an entry is only moved
+		// if it points to this file.
+		if fileID, err := fs.ss.Get(ctx, legacy.GetPathKey()); err == nil && fileID == entry.ID {
+			if _, err := fs.ss.Get(ctx, c.GetPathKey()); err == ErrStateNotFound {
+				set[c.GetPathKey()] = fileID
+			}
+			del = append(del, legacy.GetPathKey())
+		} else if err != nil && err != ErrStateNotFound {
+			return err
+		}
+		// The content hash index entry of the file is moved along with it.
+		if hash := set[c.GetContentHashKey()]; hash != "" {
+			legacyIndex := getHashIndexKey(legacy.keySpace(), hash)
+			pageID, err := fs.ss.Get(ctx, legacyIndex)
+			if err != nil && err != ErrStateNotFound {
+				return err
+			}
+			if err == nil && pageID == set[c.GetKey()] {
+				set[getHashIndexKey(c.keySpace(), hash)] = pageID
+				del = append(del, legacyIndex)
+			}
+		}
+		if len(del) == 0 {
+			continue
+		}
+		if err := fs.ss.Apply(ctx, set, del); err != nil {
+			return err
+		}
+		migrated++
+	}
+	fs.log.WithFields(logrus.Fields{
+		"Provider":  sp.Name(),
+		"Namespace": namespace,
+		"Path":      path,
+		"Files":     migrated,
+	}).Info("State keys have been migrated.")
+	return errors.Wrap(fs.ss.Set(ctx, marker, "1"), "migrateKeys failed")
+}
@@ -1,11 +1,16 @@
 package research
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
 
 	"github.com/jomei/notionapi"
 	"github.com/pkg/errors"
+	"github.com/shayanh/notionify/notionclient"
 	"github.com/sirupsen/logrus"
 )
 
@@ -14,48 +19,207 @@ type NotionPage struct {
 	Name string
 	Type string
 	URL  string
+	Tags []string
+	// SourceID and ContentHash identify the file of the page. They are empty
+	// if their properties are not in the database.
+	SourceID    string
+	ContentHash string
 }
 
-func NewNotionPage(page *notionapi.Page) *NotionPage {
-	res := &NotionPage{}
-	res.ID = string(page.ID)
+// Logical fields of the research database. Their property names and types
+// are configurable.
+const (
+	FieldName    = "name"
+	FieldTags    = "tags"
+	FieldURL     = "url"
+	FieldType    = "type"
+	FieldCreated = "created"
+	// FieldSourceID is a text property holding CloudFile.SourceID. It can be
+	// hidden in the views of the database.
+	FieldSourceID    = "sourceid"
+	FieldContentHash = "contenthash"
+)
 
-	// TODO: type assertions
-	nameProp := page.Properties["Name"]
-	if nameProp != nil {
-		titles := nameProp.(*notionapi.PageTitleProperty).Title
-		if len(titles) > 0 {
-			res.Name = titles[0].PlainText
-		}
+// DefaultSchema is the layout of the research database that is used unless
+// configured otherwise.
+var DefaultSchema = notionclient.Schema{
+	FieldName:    {Name: "Name", Type: notionapi.PropertyTypeTitle},
+	FieldTags:    {Name: "Tags", Type: notionapi.PropertyTypeMultiSelect},
+	FieldURL:     {Name: "URL", Type: notionapi.PropertyTypeURL},
+	FieldType:    {Name: "Type", Type: notionapi.PropertyTypeSelect, Optional: true},
+	FieldCreated: {Name: "Created", Type: notionapi.PropertyTypeCreatedTime, Optional: true},
+
+	FieldSourceID:    {Name: "Source ID", Type: notionapi.PropertyTypeRichText, Optional: true},
+	FieldContentHash: {Name: "Content Hash", Type: notionapi.PropertyTypeRichText, Optional: true},
+}
+
+// NewNotionPage decodes a page of the research database. Properties of
+// unexpected types are reported as notionclient.PropertyErrors, and the page
+// is returned with the other properties.
+func NewNotionPage(page *notionapi.Page, schema notionclient.Schema) (*NotionPage, error) {
+	d := notionclient.NewDecoder(page)
+	res := &NotionPage{
+		ID:   string(page.ID),
+		Name: d.Title(schema.Name(FieldName)),
+		Type: d.Select(schema.Name(FieldType)),
+		URL:  d.URL(schema.Name(FieldURL)),
+		Tags: d.MultiSelect(schema.Name(FieldTags)),
+
+		SourceID:    d.RichText(schema.Name(FieldSourceID)),
+		ContentHash: d.RichText(schema.Name(FieldContentHash)),
 	}
+	return res, d.Err()
+}
+
+const notionPagesURL = "https://api.notion.com/v1/pages/"
+const notionVersion = "2021-05-13"
+
+// NotionProperties names the properties of the research database. Empty
+// names of optional properties are not written.
+type NotionProperties struct {
+	// Schema names the properties of the logical fields. DefaultSchema is
+	// used when it is nil.
+	Schema notionclient.Schema
+
+	// Folder is a text property holding the folder of the file.
+	Folder string
+	// Folders maps the folders of the file to a select or multi-select
+	// property.
+	Folders FolderMapping
+	// Alternates is a text property listing the other locations of a file,
+	// written by DuplicatePolicyAlternate.
+	Alternates string
 
-	typeProp := page.Properties["Type"]
-	if typeProp != nil {
-		res.Type = typeProp.(*notionapi.SelectOptionProperty).Select.Name
+	// Extracted metadata, written when a page is created. Authors, DOI,
+	// ArXivID, Venue and Abstract are text properties, Year and PageCount are
+	// number properties and Keywords is a multi-select property.
+	Authors   string
+	Year      string
+	DOI       string
+	ArXivID   string
+	Venue     string
+	Abstract  string
+	Keywords  string
+	PageCount string
+}
+
+// schema returns the properties expected in the database, including the
+// optional ones that are configured.
+func (p NotionProperties) schema() notionclient.Schema {
+	schema := make(notionclient.Schema)
+	for field, prop := range p.Schema {
+		schema[field] = prop
 	}
+	add := func(field string, name string, typ notionapi.PropertyType) {
+		if name != "" {
+			schema[field] = notionclient.Property{Name: name, Type: typ}
+		}
+	}
+	add("folder", p.Folder, notionapi.PropertyTypeRichText)
+	add("folders", p.Folders.Property, notionapi.PropertyType(p.Folders.Type))
+	add("alternates", p.Alternates, notionapi.PropertyTypeRichText)
+	add("authors", p.Authors, notionapi.PropertyTypeRichText)
+	add("year", p.Year, notionapi.PropertyTypeNumber)
+	add("doi", p.DOI, notionapi.PropertyTypeRichText)
+	add("arxiv", p.ArXivID, notionapi.PropertyTypeRichText)
+	add("venue", p.Venue, notionapi.PropertyTypeRichText)
+	add("abstract", p.Abstract, notionapi.PropertyTypeRichText)
+	add("keywords", p.Keywords, notionapi.PropertyTypeMultiSelect)
+	add("pagecount", p.PageCount, notionapi.PropertyTypeNumber)
+	return schema
+}
+
+// numberProperty is a number property value. notionapi.NumberProperty only
+// describes the schema of a number property.
+type numberProperty struct {
+	Type   notionapi.PropertyType `json:"type"`
+	Number float64                `json:"number"`
+}
+
+func (p numberProperty) GetType() notionapi.PropertyType {
+	return p.Type
+}
 
-	urlProp := page.Properties["URL"]
-	if urlProp != nil {
-		res.URL = page.Properties["URL"].(*notionapi.URLProperty).URL.(string)
+// maxRichTextLength is the maximum length of a Notion text object.
+const maxRichTextLength = 2000
+
+func richTextProperty(content string) notionapi.RichTextProperty {
+	if runes := []rune(content); len(runes) > maxRichTextLength {
+		content = string(runes[:maxRichTextLength])
+	}
+	return notionapi.RichTextProperty{
+		Type: notionapi.PropertyTypeRichText,
+		RichText: []notionapi.RichText{
+			{
+				Text: notionapi.Text{
+					Content: content,
+				},
+			},
+		},
 	}
-	return res
 }
 
 type NotionHandler struct {
 	databaseID notionapi.DatabaseID
+	token      notionapi.Token
+	props      NotionProperties
 	nc         *notionapi.Client
+	client     *http.Client
 }
 
-func NewNotionHandler(token string, databaseID string) *NotionHandler {
+// NewNotionHandler returns a handler for the database. All requests are sent
+// with client, which is shared by the handlers of the process.
+func NewNotionHandler(token string, databaseID string, props NotionProperties, client *http.Client) *NotionHandler {
+	if props.Schema == nil {
+		props.Schema = DefaultSchema
+	}
 	return &NotionHandler{
-		nc:         notionapi.NewClient(notionapi.Token(token)),
+		nc:         notionapi.NewClient(notionapi.Token(token), notionapi.WithHTTPClient(client)),
+		token:      notionapi.Token(token),
 		databaseID: notionapi.DatabaseID(databaseID),
+		props:      props,
+		client:     client,
 	}
 }
 
+// ValidateSchema checks the configured properties against the schema of the
+// database. Optional fields whose property does not exist are disabled.
+func (nh *NotionHandler) ValidateSchema(ctx context.Context) error {
+	types, err := notionclient.FetchSchema(ctx, nh.client, nh.token.String(), nh.databaseID.String())
+	if err != nil {
+		return errors.Wrap(err, "notion handler ValidateSchema failed")
+	}
+	resolved, err := nh.props.schema().Resolve(types)
+	if err != nil {
+		return errors.Wrapf(err, "notion handler ValidateSchema failed for database %s", nh.databaseID)
+	}
+	schema := make(notionclient.Schema)
+	for field := range nh.props.Schema {
+		schema[field] = resolved[field]
+	}
+	nh.props.Schema = schema
+	return nil
+}
+
+// PropertyName returns the name of the property of a logical field.
+func (nh *NotionHandler) PropertyName(field string) string {
+	return nh.props.Schema.Name(field)
+}
+
+func (nh *NotionHandler) newNotionPage(page *notionapi.Page) (*NotionPage, error) {
+	return NewNotionPage(page, nh.props.Schema)
+}
+
+// writtenPage decodes the page returned by a write. The write succeeded, so
+// properties that cannot be decoded are left empty instead of failing it.
+func (nh *NotionHandler) writtenPage(page *notionapi.Page) *NotionPage {
+	res, _ := nh.newNotionPage(page)
+	return res
+}
+
 func (nh *NotionHandler) getProperties(c *CloudFile) notionapi.Properties {
-	return notionapi.Properties{
-		"Name": notionapi.PageTitleProperty{
+	props := notionapi.Properties{
+		nh.PropertyName(FieldName): notionapi.PageTitleProperty{
 			Title: notionapi.Paragraph{
 				notionapi.RichText{
 					Text: notionapi.Text{
@@ -64,21 +228,152 @@ func (nh *NotionHandler) getProperties(c *CloudFile) notionapi.Properties {
 				},
 			},
 		},
-		"Tags": notionapi.MultiSelectOptionsProperty{
-			Type: "multi_select",
-			MultiSelect: func() []notionapi.Option {
-				var res []notionapi.Option
-				for _, tag := range c.Tags {
-					res = append(res, notionapi.Option{Name: tag})
-				}
-				return res
-			}(),
-		},
-		"URL": notionapi.URLProperty{
+		nh.PropertyName(FieldTags): multiSelectProperty(c.Tags),
+		nh.PropertyName(FieldURL): notionapi.URLProperty{
 			Type: "url",
 			URL:  c.URL,
 		},
 	}
+	if nh.props.Folder != "" && c.Path != "" {
+		props[nh.props.Folder] = richTextProperty(path.Dir(c.Path))
+	}
+	if sourceID := nh.PropertyName(FieldSourceID); sourceID != "" && c.FileID != "" {
+		props[sourceID] = richTextProperty(c.SourceID())
+	}
+	if contentHash := nh.PropertyName(FieldContentHash); contentHash != "" && c.ContentHash != "" {
+		props[contentHash] = richTextProperty(c.ContentHash)
+	}
+	nh.addMetadataProperties(props, c)
+	if folders := nh.props.Folders; folders.Enabled() {
+		values := nh.FolderValues(c)
+		switch folders.Type {
+		case FolderPropertyMultiSelect:
+			if folders.Property == nh.PropertyName(FieldTags) {
+				values = append(append([]string{}, c.Tags...), values...)
+			}
+			props[folders.Property] = multiSelectProperty(values)
+		case FolderPropertySelect:
+			if len(values) > 0 {
+				props[folders.Property] = selectProperty(values[0])
+			}
+		}
+	}
+	return props
+}
+
+func (nh *NotionHandler) addMetadataProperties(props notionapi.Properties, c *CloudFile) {
+	if nh.props.Authors != "" && len(c.Authors) > 0 {
+		props[nh.props.Authors] = richTextProperty(strings.Join(c.Authors, ", "))
+	}
+	if nh.props.Year != "" && c.Year != 0 {
+		props[nh.props.Year] = numberProperty{Type: notionapi.PropertyTypeNumber, Number: float64(c.Year)}
+	}
+	if nh.props.DOI != "" && c.DOI != "" {
+		props[nh.props.DOI] = richTextProperty(c.DOI)
+	}
+	if nh.props.ArXivID != "" && c.ArXivID != "" {
+		props[nh.props.ArXivID] = richTextProperty(c.ArXivID)
+	}
+	if nh.props.Venue != "" && c.Venue != "" {
+		props[nh.props.Venue] = richTextProperty(c.Venue)
+	}
+	if nh.props.Abstract != "" && c.Abstract != "" {
+		props[nh.props.Abstract] = richTextProperty(c.Abstract)
+	}
+	if nh.props.Keywords != "" && len(c.Keywords) > 0 {
+		props[nh.props.Keywords] = multiSelectProperty(c.Keywords)
+	}
+	if nh.props.PageCount != "" && c.PageCount != 0 {
+		props[nh.props.PageCount] = numberProperty{Type: notionapi.PropertyTypeNumber, Number: float64(c.PageCount)}
+	}
+}
+
+func multiSelectProperty(names []string) notionapi.MultiSelectOptionsProperty {
+	var options []notionapi.Option
+	for _, name := range names {
+		options = append(options, notionapi.Option{Name: name})
+	}
+	return notionapi.MultiSelectOptionsProperty{
+		Type:        notionapi.PropertyTypeMultiSelect,
+		MultiSelect: options,
+	}
+}
+
+func selectProperty(name string) *notionapi.SelectOptionProperty {
+	return &notionapi.SelectOptionProperty{
+		Type:   notionapi.PropertyTypeSelect,
+		Select: notionapi.Option{Name: name},
+	}
+}
+
+// FolderValues returns the values of the folder property for c.
+func (nh *NotionHandler) FolderValues(c *CloudFile) []string {
+	return nh.props.Folders.Map(c.Folders)
+}
+
+// SetFolderValues replaces the folder values previously written to the page,
+// oldValues, with newValues. Other options of a multi-select property are
+// kept.
+func (nh *NotionHandler) SetFolderValues(ctx context.Context, pageID string, oldValues []string, newValues []string) (*NotionPage, error) {
+	folders := nh.props.Folders
+	var prop notionapi.Property
+	switch folders.Type {
+	case FolderPropertySelect:
+		var option *notionapi.SelectOptionProperty
+		if len(newValues) > 0 {
+			option = selectProperty(newValues[0])
+		}
+		prop = option
+	case FolderPropertyMultiSelect:
+		page, err := nh.nc.Page.Get(ctx, notionapi.PageID(pageID))
+		if err != nil {
+			return nil, errors.Wrap(err, "notion handler SetFolderValues failed")
+		}
+		var names []string
+		if current, ok := page.Properties[folders.Property].(*notionapi.MultiSelectOptionsProperty); ok {
+			for _, option := range current.MultiSelect {
+				if !containsString(oldValues, option.Name) {
+					names = append(names, option.Name)
+				}
+			}
+		}
+		for _, value := range newValues {
+			if !containsString(names, value) {
+				names = append(names, value)
+			}
+		}
+		prop = multiSelectProperty(names)
+	default:
+		return nil, errors.Errorf("notion handler SetFolderValues: unsupported property type %q", folders.Type)
+	}
+
+	req := &notionapi.PageUpdateRequest{
+		Properties: notionapi.Properties{
+			folders.Property: prop,
+		},
+	}
+	page, err := nh.nc.Page.Update(ctx, notionapi.PageID(pageID), req)
+	if err != nil {
+		return nil, errors.Wrap(err, "notion handler SetFolderValues failed")
+	}
+	return nh.writtenPage(page), nil
+}
+
+// SetAlternates replaces the alternate locations of the page with locations.
+func (nh *NotionHandler) SetAlternates(ctx context.Context, pageID string, locations []string) (*NotionPage, error) {
+	if nh.props.Alternates == "" {
+		return nil, errors.New("notion handler SetAlternates: no alternates property configured")
+	}
+	req := &notionapi.PageUpdateRequest{
+		Properties: notionapi.Properties{
+			nh.props.Alternates: richTextProperty(strings.Join(locations, "\n")),
+		},
+	}
+	page, err := nh.nc.Page.Update(ctx, notionapi.PageID(pageID), req)
+	if err != nil {
+		return nil, errors.Wrap(err, "notion handler SetAlternates failed")
+	}
+	return nh.writtenPage(page), nil
 }
 
 func debugJSON(obj interface{}) {
@@ -101,16 +396,24 @@ func (nh *NotionHandler) CreatePage(ctx context.Context, c *CloudFile) (*NotionP
 	if err != nil {
 		return nil, errors.Wrap(err, "notion handler CreatePage failed")
 	}
-	return NewNotionPage(page), nil
+	return nh.writtenPage(page), nil
 }
 
-func (nh *NotionHandler) UpdatePage(ctx context.Context, c *CloudFile, pageID string) (*NotionPage, error) {
+// UpdatePage updates the URL property of the page, the folder, source ID and
+// content hash properties if they are configured, and the given extra
+// properties.
+func (nh *NotionHandler) UpdatePage(ctx context.Context, c *CloudFile, pageID string, extraProps ...string) (*NotionPage, error) {
 	req := &notionapi.PageUpdateRequest{
 		Properties: nh.getProperties(c),
 	}
-	// We only update URL property
+	keep := append([]string{
+		nh.PropertyName(FieldURL),
+		nh.props.Folder,
+		nh.PropertyName(FieldSourceID),
+		nh.PropertyName(FieldContentHash),
+	}, extraProps...)
 	for prop := range req.Properties {
-		if prop != "URL" {
+		if !containsString(keep, prop) {
 			delete(req.Properties, prop)
 		}
 	}
@@ -119,31 +422,176 @@ func (nh *NotionHandler) UpdatePage(ctx context.Context, c *CloudFile, pageID st
 	if err != nil {
 		return nil, errors.Wrap(err, "notion handler UpdatePage failed")
 	}
-	return NewNotionPage(page), nil
+	return nh.writtenPage(page), nil
 }
 
+// ListPages lists the pages of the database. Pages that cannot be decoded are
+// left out and reported by a notionclient.MalformedPagesError, which is
+// returned along with the other pages.
 func (nh *NotionHandler) ListPages(ctx context.Context) ([]*NotionPage, error) {
 	var pages []*NotionPage
+	var malformed []error
 	var cursor notionapi.Cursor
 	for hasMore := true; hasMore; {
 		req := &notionapi.DatabaseQueryRequest{
-			Sorts: []notionapi.SortObject{
+			StartCursor: cursor,
+		}
+		if created := nh.PropertyName(FieldCreated); created != "" {
+			req.Sorts = []notionapi.SortObject{
 				{
-					Property:  "Created",
+					Property:  created,
 					Direction: "ascending",
 				},
-			},
-			StartCursor: cursor,
+			}
 		}
 		resp, err := nh.nc.Database.Query(ctx, nh.databaseID, req)
 		if err != nil {
 			return nil, err
 		}
 		for _, page := range resp.Results {
-			pages = append(pages, NewNotionPage(&page))
+			res, err := nh.newNotionPage(&page)
+			if err != nil {
+				malformed = append(malformed, err)
+				continue
+			}
+			pages = append(pages, res)
 		}
 		hasMore = resp.HasMore
 		cursor = resp.NextCursor
 	}
+	if len(malformed) > 0 {
+		return pages, &notionclient.MalformedPagesError{Errs: malformed}
+	}
 	return pages, nil
 }
+
+// FindPageBySourceID returns the page whose source ID property is sourceID,
+// or nil if there is none or the property is not in the database. The oldest
+// page is returned if there are several.
+func (nh *NotionHandler) FindPageBySourceID(ctx context.Context, sourceID string) (*NotionPage, error) {
+	prop := nh.PropertyName(FieldSourceID)
+	if prop == "" {
+		return nil, nil
+	}
+	req := &notionapi.DatabaseQueryRequest{
+		Filter: notionapi.PropertyFilter{
+			Property: notionapi.PropertyType(prop),
+			Text: map[notionapi.Condition]string{
+				"equals": sourceID,
+			},
+		},
+		PageSize: 1,
+	}
+	if created := nh.PropertyName(FieldCreated); created != "" {
+		req.Sorts = []notionapi.SortObject{
+			{
+				Property:  created,
+				Direction: "ascending",
+			},
+		}
+	}
+	resp, err := nh.nc.Database.Query(ctx, nh.databaseID, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "notion handler FindPageBySourceID failed")
+	}
+	if len(resp.Results) == 0 {
+		return nil, nil
+	}
+	res, err := nh.newNotionPage(&resp.Results[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "notion handler FindPageBySourceID failed")
+	}
+	return res, nil
+}
+
+func (nh *NotionHandler) GetPage(ctx context.Context, pageID string) (*NotionPage, error) {
+	page, err := nh.nc.Page.Get(ctx, notionapi.PageID(pageID))
+	if err != nil {
+		return nil, errors.Wrap(err, "notion handler GetPage failed")
+	}
+	res, err := nh.newNotionPage(page)
+	if err != nil {
+		return nil, errors.Wrap(err, "notion handler GetPage failed")
+	}
+	return res, nil
+}
+
+// AddTags adds the given tags to the page, keeping its current tags.
+func (nh *NotionHandler) AddTags(ctx context.Context, pageID string, tags ...string) (*NotionPage, error) {
+	page, err := nh.GetPage(ctx, pageID)
+	if err != nil {
+		return nil, errors.Wrap(err, "notion handler AddTags failed")
+	}
+	names := page.Tags
+	for _, tag := range tags {
+		if !containsString(names, tag) {
+			names = append(names, tag)
+		}
+	}
+	req := &notionapi.PageUpdateRequest{
+		Properties: notionapi.Properties{
+			nh.PropertyName(FieldTags): multiSelectProperty(names),
+		},
+	}
+	updated, err := nh.nc.Page.Update(ctx, notionapi.PageID(pageID), req)
+	if err != nil {
+		return nil, errors.Wrap(err, "notion handler AddTags failed")
+	}
+	return nh.writtenPage(updated), nil
+}
+
+// ClearURL removes the URL of the page.
+func (nh *NotionHandler) ClearURL(ctx context.Context, pageID string) (*NotionPage, error) {
+	req := &notionapi.PageUpdateRequest{
+		Properties: notionapi.Properties{
+			nh.PropertyName(FieldURL): notionapi.URLProperty{
+				Type: "url",
+				URL:  nil,
+			},
+		},
+	}
+	page, err := nh.nc.Page.Update(ctx, notionapi.PageID(pageID), req)
+	if err != nil {
+		return nil, errors.Wrap(err, "notion handler ClearURL failed")
+	}
+	return nh.writtenPage(page), nil
+}
+
+// ArchivePage archives the page. notionapi does not support archiving, so the
+// request is sent directly.
+func (nh *NotionHandler) ArchivePage(ctx context.Context, pageID string) error {
+	body, err := json.Marshal(map[string]bool{"archived": true})
+	if err != nil {
+		return errors.Wrap(err, "notion handler ArchivePage failed")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, notionPagesURL+pageID, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "notion handler ArchivePage failed")
+	}
+	req.Header.Add("Authorization", "Bearer "+nh.token.String())
+	req.Header.Add("Notion-Version", notionVersion)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := nh.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "notion handler ArchivePage failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr notionapi.Error
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			return errors.Wrapf(err, "notion handler ArchivePage failed with status %d", resp.StatusCode)
+		}
+		return errors.Wrap(&apiErr, "notion handler ArchivePage failed")
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
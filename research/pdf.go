@@ -3,6 +3,8 @@ package research
 import (
 	"errors"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
 
 	pdfcpu "github.com/pdfcpu/pdfcpu/pkg/api"
@@ -37,6 +39,77 @@ func GetPDFTitleFromReadSeeker(rs io.ReadSeeker) (string, error) {
 	return getTitle(info)
 }
 
+// PDFInfo is the document information of a PDF file.
+type PDFInfo struct {
+	Title        string
+	Author       string
+	Subject      string
+	Keywords     []string
+	CreationDate string
+	PageCount    int
+}
+
+var pdfDateYear = regexp.MustCompile(`^(?:D:)?(\d{4})`)
+
+// Year returns the year of the creation date, or zero if it is unknown.
+func (pi *PDFInfo) Year() int {
+	m := pdfDateYear.FindStringSubmatch(pi.CreationDate)
+	if m == nil {
+		return 0
+	}
+	year, _ := strconv.Atoi(m[1])
+	return year
+}
+
+// parsePDFInfo parses the "label: value" lines returned by pdfcpu.Info.
+// Keywords after the first one are printed on indented lines without a label.
+func parsePDFInfo(info []string) *PDFInfo {
+	res := &PDFInfo{}
+	continuation := strings.Repeat(" ", 22)
+	lastLabel := ""
+	for _, line := range info {
+		if lastLabel == "Keywords" && strings.HasPrefix(line, continuation) {
+			if keyword := strings.TrimSpace(line); keyword != "" {
+				res.Keywords = append(res.Keywords, keyword)
+			}
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			lastLabel = ""
+			continue
+		}
+		label := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		lastLabel = label
+		switch label {
+		case "Title":
+			res.Title = value
+		case "Author":
+			res.Author = value
+		case "Subject":
+			res.Subject = value
+		case "Keywords":
+			if value != "" {
+				res.Keywords = append(res.Keywords, value)
+			}
+		case "Creation date":
+			res.CreationDate = value
+		case "Page count":
+			res.PageCount, _ = strconv.Atoi(value)
+		}
+	}
+	return res
+}
+
+func GetPDFInfoFromReadSeeker(rs io.ReadSeeker) (*PDFInfo, error) {
+	info, err := pdfcpu.Info(rs, []string{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parsePDFInfo(info), nil
+}
+
 func IsPDF(filePath string) bool {
 	filePath = strings.ToLower(filePath)
 	return strings.HasSuffix(filePath, ".pdf")
@@ -0,0 +1,232 @@
+package research
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// EntryKind is the kind of a StorageEntry.
+type EntryKind int
+
+const (
+	EntryFile EntryKind = iota
+	EntryFolder
+	EntryDeleted
+)
+
+// StorageEntry is a file, a folder or a deletion reported by a
+// StorageProvider. Deleted entries only carry a path.
+type StorageEntry struct {
+	Kind        EntryKind
+	ID          string
+	Path        string
+	Size        int64
+	Rev         string
+	ContentHash string
+	Modified    time.Time
+}
+
+// StorageProvider is a cloud storage whose files are synchronized with
+// Notion.
+type StorageProvider interface {
+	// Name identifies the provider in CloudFile.Provider and in the keys
+	// stored in redis.
+	Name() string
+	// List returns the entries below path that changed since cursor, and a
+	// new cursor. An empty cursor lists all entries.
+	List(ctx context.Context, path string, cursor string, recursive bool) ([]*StorageEntry, string, error)
+	GetMetadata(ctx context.Context, path string) (*StorageEntry, error)
+	// ShareLink returns a link that the file can be viewed at.
+	ShareLink(ctx context.Context, entry *StorageEntry) (string, error)
+	Download(ctx context.Context, entry *StorageEntry) (io.ReadCloser, error)
+	Upload(ctx context.Context, path string, content io.Reader) (*StorageEntry, error)
+}
+
+// BatchLinker is implemented by providers that can look up the share links
+// of many files at once.
+type BatchLinker interface {
+	// ShareLinks returns the links of entries by entry ID. Entries whose link
+	// could not be looked up are missing from the result.
+	ShareLinks(ctx context.Context, entries []*StorageEntry) (map[string]string, error)
+}
+
+// LinkFinder is implemented by providers whose ShareLink creates a link when
+// the file has none.
+type LinkFinder interface {
+	// FindShareLinks returns the existing links of entries by entry ID. No
+	// links are created.
+	FindShareLinks(ctx context.Context, entries []*StorageEntry) (map[string]string, error)
+}
+
+// CloudFileBuilder builds the CloudFiles of the entries of a
+// StorageProvider.
+type CloudFileBuilder struct {
+	sp        StorageProvider
+	namespace string
+	ec        *ExtractorChain
+	log       *logrus.Logger
+
+	// maxExtractSize is the size in bytes above which files are not
+	// downloaded for extraction. Zero means no limit.
+	maxExtractSize int64
+	// workers is the number of files built concurrently by BuildAll.
+	workers    int
+	extraction extractionCounter
+}
+
+// defaultBuildWorkers is the number of files built concurrently when no
+// number is given.
+const defaultBuildWorkers = 4
+
+// NewCloudFileBuilder returns a builder for the entries of sp. namespace
+// separates the state of different accounts of the same provider and may be
+// empty when only one account is synchronized. BuildAll builds up to workers
+// files concurrently.
+func NewCloudFileBuilder(sp StorageProvider, namespace string, ec *ExtractorChain, maxExtractSize int64, workers int, log *logrus.Logger) *CloudFileBuilder {
+	if workers <= 0 {
+		workers = defaultBuildWorkers
+	}
+	return &CloudFileBuilder{
+		sp:             sp,
+		namespace:      namespace,
+		ec:             ec,
+		log:            log,
+		maxExtractSize: maxExtractSize,
+		workers:        workers,
+	}
+}
+
+func (cb *CloudFileBuilder) Provider() StorageProvider {
+	return cb.sp
+}
+
+func (cb *CloudFileBuilder) Namespace() string {
+	return cb.namespace
+}
+
+// ExtractionStats returns the cost of the downloads done for extraction since
+// the builder was created.
+func (cb *CloudFileBuilder) ExtractionStats() ExtractionStats {
+	return cb.extraction.stats()
+}
+
+func (cb *CloudFileBuilder) Build(ctx context.Context, entry *StorageEntry) (*CloudFile, error) {
+	link, err := cb.sp.ShareLink(ctx, entry)
+	if err != nil {
+		return nil, errors.Wrap(err, "cloudfile Build failed")
+	}
+	return cb.build(ctx, entry, link), nil
+}
+
+// BuildAll builds the CloudFiles of entries. Links are looked up in batches
+// if the provider is a BatchLinker, and the downloads for extraction run
+// concurrently. The results and errors are in the order of entries, and
+// exactly one of them is set for each entry.
+func (cb *CloudFileBuilder) BuildAll(ctx context.Context, entries []*StorageEntry) ([]*CloudFile, []error) {
+	cloudFiles := make([]*CloudFile, len(entries))
+	errs := make([]error, len(entries))
+
+	var links map[string]string
+	if bl, ok := cb.sp.(BatchLinker); ok && len(entries) > 1 {
+		var err error
+		links, err = bl.ShareLinks(ctx, entries)
+		if err != nil {
+			// The links are looked up one by one instead.
+			cb.log.Warn(err)
+		}
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < cb.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				entry := entries[i]
+				if link, ok := links[entry.ID]; ok {
+					cloudFiles[i] = cb.build(ctx, entry, link)
+				} else {
+					cloudFiles[i], errs[i] = cb.Build(ctx, entry)
+				}
+			}
+		}()
+	}
+	for i := range entries {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return cloudFiles, errs
+}
+
+func (cb *CloudFileBuilder) build(ctx context.Context, entry *StorageEntry, link string) *CloudFile {
+	cloudFile := &CloudFile{
+		FileID:      entry.ID,
+		Path:        entry.Path,
+		URL:         link,
+		Provider:    cb.sp.Name(),
+		Namespace:   cb.namespace,
+		ContentHash: entry.ContentHash,
+	}
+	cb.extractMetadata(ctx, entry, cloudFile)
+	return cloudFile
+}
+
+// Upload uploads content to the provider and builds its CloudFile.
+func (cb *CloudFileBuilder) Upload(path string, content io.Reader) (*CloudFile, error) {
+	ctx := context.Background()
+	entry, err := cb.sp.Upload(ctx, path, content)
+	if err != nil {
+		return nil, errors.Wrap(err, "cloudfile Upload failed")
+	}
+	return cb.Build(ctx, entry)
+}
+
+// extractMetadata runs the extractor chain on the file. Extraction errors are
+// logged and the fields that could be extracted are kept.
+func (cb *CloudFileBuilder) extractMetadata(ctx context.Context, entry *StorageEntry, c *CloudFile) {
+	src := NewSource(entry.Path, func() (io.ReadSeeker, error) {
+		if cb.maxExtractSize > 0 && entry.Size > cb.maxExtractSize {
+			cb.extraction.addSkipped()
+			return nil, ErrFileTooLarge
+		}
+		start := time.Now()
+		reader, err := cb.sp.Download(ctx, entry)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := reader.Close(); err != nil {
+				cb.log.Error(err)
+			}
+		}()
+
+		content, n, err := DownloadToTemp(reader, cb.maxExtractSize)
+		elapsed := time.Since(start)
+		cb.extraction.addDownload(n, elapsed)
+		cb.log.WithFields(logrus.Fields{
+			"Path":     entry.Path,
+			"Bytes":    n,
+			"Duration": elapsed,
+		}).Debug("Downloaded file for extraction")
+		if err == ErrFileTooLarge {
+			cb.extraction.addSkipped()
+		}
+		return content, err
+	})
+	defer func() {
+		if err := src.Close(); err != nil {
+			cb.log.Error(err)
+		}
+	}()
+
+	if err := cb.ec.Extract(ctx, src, c); err != nil {
+		cb.log.WithField("Path", entry.Path).Debug(err)
+	}
+}
@@ -0,0 +1,420 @@
+package research
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	syncJobsStream = "sync-jobs"
+	syncJobsGroup  = "notionify"
+
+	// defaultQueueWorkers is the number of jobs processed concurrently when
+	// no number is given.
+	defaultQueueWorkers = 2
+	// defaultVisibilityTimeout is how long a job may go without being
+	// extended by its worker before another worker takes it over, when no
+	// timeout is given.
+	defaultVisibilityTimeout = 10 * time.Minute
+	// maxJobDeliveries is how often a job is delivered before it is dropped.
+	maxJobDeliveries = 5
+)
+
+// SyncQueue is a durable queue of folder synchronizations in a redis stream.
+// Enqueuing a folder that already has a pending job is a no-op, so a burst of
+// notifications results in one synchronization. Running jobs are extended
+// periodically. Jobs that are neither extended nor acknowledged within the
+// visibility timeout, e.g. because the process was restarted, are taken over
+// by another worker. It needs Redis 6.2 or later.
+//
+// Without a redis client, jobs are queued in memory and are lost when the
+// process exits. Failed jobs are retried after the visibility timeout.
+type SyncQueue struct {
+	rdb           *redis.Client
+	synchronizers map[string]*FolderSynchronizer
+	workers       int
+	visibility    time.Duration
+	consumer      string
+	log           *logrus.Logger
+	lock          sync.RWMutex
+
+	local localJobs
+}
+
+// localJobs are the jobs of a queue without redis.
+type localJobs struct {
+	jobs    []localJob
+	pending map[string]bool
+	notify  chan struct{}
+	lock    sync.Mutex
+}
+
+type localJob struct {
+	name       string
+	path       string
+	deliveries int
+}
+
+// NewSyncQueue returns a queue in redis, or in memory if rdb is nil.
+func NewSyncQueue(rdb *redis.Client, workers int, visibility time.Duration, log *logrus.Logger) *SyncQueue {
+	if workers <= 0 {
+		workers = defaultQueueWorkers
+	}
+	if visibility <= 0 {
+		visibility = defaultVisibilityTimeout
+	}
+	hostname, _ := os.Hostname()
+	return &SyncQueue{
+		rdb:           rdb,
+		synchronizers: make(map[string]*FolderSynchronizer),
+		workers:       workers,
+		visibility:    visibility,
+		consumer:      fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		log:           log,
+		local: localJobs{
+			pending: make(map[string]bool),
+			notify:  make(chan struct{}, 1),
+		},
+	}
+}
+
+// Register makes the jobs of fs processable. Synchronizers have to be
+// registered before Run, also when this process does not enqueue their jobs.
+func (sq *SyncQueue) Register(fs *FolderSynchronizer) {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	sq.synchronizers[fs.Name()] = fs
+}
+
+func (sq *SyncQueue) synchronizer(name string) (*FolderSynchronizer, bool) {
+	sq.lock.RLock()
+	defer sq.lock.RUnlock()
+	fs, ok := sq.synchronizers[name]
+	return fs, ok
+}
+
+func getPendingJobKey(name string, path string) string {
+	return "sync-job-pending-" + name + "-" + strings.ToLower(path)
+}
+
+// Enqueue adds a job to synchronize path with fs, unless one is pending.
+func (sq *SyncQueue) Enqueue(ctx context.Context, fs *FolderSynchronizer, path string) error {
+	if sq.rdb == nil {
+		sq.enqueueLocal(localJob{name: fs.Name(), path: path})
+		return nil
+	}
+	key := getPendingJobKey(fs.Name(), path)
+	// The marker expires in case its job is dropped without clearing it.
+	ok, err := sq.rdb.SetNX(ctx, key, time.Now().Unix(), maxJobDeliveries*sq.visibility).Result()
+	if err != nil {
+		return errors.Wrap(err, "Enqueue failed")
+	}
+	if !ok {
+		sq.log.WithFields(logrus.Fields{
+			"Synchronizer": fs.Name(),
+			"Path":         path,
+		}).Debug("Sync job is already pending")
+		return nil
+	}
+	err = sq.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: syncJobsStream,
+		Values: map[string]interface{}{
+			"synchronizer": fs.Name(),
+			"path":         path,
+		},
+	}).Err()
+	if err != nil {
+		sq.rdb.Del(ctx, key)
+		return errors.Wrap(err, "Enqueue failed")
+	}
+	return nil
+}
+
+// Run processes jobs until ctx is done.
+func (sq *SyncQueue) Run(ctx context.Context) error {
+	if sq.rdb == nil {
+		sq.runLocal(ctx)
+		return nil
+	}
+	err := sq.rdb.XGroupCreateMkStream(ctx, syncJobsStream, syncJobsGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.Wrap(err, "SyncQueue Run failed")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < sq.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sq.work(ctx)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sq.reclaim(ctx)
+	}()
+	wg.Wait()
+	return nil
+}
+
+// work reads new jobs from the stream and processes them.
+func (sq *SyncQueue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		streams, err := sq.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    syncJobsGroup,
+			Consumer: sq.consumer,
+			Streams:  []string{syncJobsStream, ">"},
+			Count:    1,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				sq.log.WithError(err).Error("cannot read sync jobs")
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+			continue
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				sq.process(ctx, msg)
+			}
+		}
+	}
+}
+
+// reclaim takes over jobs that were not acknowledged within the visibility
+// timeout.
+func (sq *SyncQueue) reclaim(ctx context.Context) {
+	ticker := time.NewTicker(sq.visibility / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := "0-0"
+		for {
+			msgs, next, err := sq.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   syncJobsStream,
+				Group:    syncJobsGroup,
+				MinIdle:  sq.visibility,
+				Start:    start,
+				Count:    10,
+				Consumer: sq.consumer,
+			}).Result()
+			if err != nil {
+				sq.log.WithError(err).Error("cannot reclaim sync jobs")
+				break
+			}
+			for _, msg := range msgs {
+				if sq.deliveries(ctx, msg.ID) > maxJobDeliveries {
+					sq.log.WithField("Job", msg.Values).Error("Sync job failed too often and is dropped.")
+					sq.finish(ctx, msg)
+					continue
+				}
+				sq.process(ctx, msg)
+			}
+			if next == "0-0" || next == "" {
+				break
+			}
+			start = next
+		}
+	}
+}
+
+// deliveries returns how often the job has been delivered.
+func (sq *SyncQueue) deliveries(ctx context.Context, id string) int64 {
+	pending, err := sq.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: syncJobsStream,
+		Group:  syncJobsGroup,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return 0
+	}
+	return pending[0].RetryCount
+}
+
+// finish acknowledges and removes a job.
+func (sq *SyncQueue) finish(ctx context.Context, msg redis.XMessage) {
+	if err := sq.rdb.XAck(ctx, syncJobsStream, syncJobsGroup, msg.ID).Err(); err != nil {
+		sq.log.WithError(err).Error("cannot acknowledge sync job")
+	}
+	if err := sq.rdb.XDel(ctx, syncJobsStream, msg.ID).Err(); err != nil {
+		sq.log.WithError(err).Error("cannot delete sync job")
+	}
+}
+
+// process runs a job. Failed jobs are not acknowledged, so they are retried
+// after the visibility timeout.
+func (sq *SyncQueue) process(ctx context.Context, msg redis.XMessage) {
+	defer func() {
+		if r := recover(); r != nil {
+			sq.log.Errorf("Recovered from panic: %s", r)
+		}
+	}()
+
+	name, _ := msg.Values["synchronizer"].(string)
+	path, _ := msg.Values["path"].(string)
+
+	// Notifications that arrive from now on need a new job, as they may not
+	// be covered by this one.
+	if err := sq.rdb.Del(ctx, getPendingJobKey(name, path)).Err(); err != nil {
+		sq.log.WithError(err).Error("cannot clear pending sync job")
+	}
+
+	// Long synchronizations keep the job, so that it is not taken over by
+	// another worker while it is running.
+	stop := keepAlive(sq.visibility/3, func() {
+		err := sq.rdb.XClaimJustID(ctx, &redis.XClaimArgs{
+			Stream:   syncJobsStream,
+			Group:    syncJobsGroup,
+			Consumer: sq.consumer,
+			Messages: []string{msg.ID},
+		}).Err()
+		if err != nil {
+			sq.log.WithError(err).Error("cannot extend sync job")
+		}
+	})
+	done := sq.sync(ctx, name, path)
+	stop()
+	if done {
+		sq.finish(ctx, msg)
+	}
+}
+
+// sync synchronizes path with the synchronizer name. It reports whether the
+// job is done, i.e. it does not have to be retried.
+func (sq *SyncQueue) sync(ctx context.Context, name string, path string) bool {
+	fs, ok := sq.synchronizer(name)
+	if !ok {
+		sq.log.WithField("Synchronizer", name).Error("Sync job for unknown synchronizer is dropped.")
+		return true
+	}
+
+	pages, err := fs.SyncFolder(ctx, path)
+	if err != nil {
+		sq.log.WithFields(logrus.Fields{
+			"Synchronizer": name,
+			"Path":         path,
+		}).Error(err)
+		if !IsDeadLettered(err) {
+			return false
+		}
+	}
+	for _, page := range pages {
+		sq.log.WithFields(logrus.Fields{
+			"Synchronizer": name,
+			"Name":         page.Name,
+			"ID":           page.ID,
+		}).Info("Synced page")
+	}
+	return true
+}
+
+func (sq *SyncQueue) enqueueLocal(job localJob) {
+	lj := &sq.local
+	lj.lock.Lock()
+	defer lj.lock.Unlock()
+	key := getPendingJobKey(job.name, job.path)
+	if lj.pending[key] {
+		sq.log.WithFields(logrus.Fields{
+			"Synchronizer": job.name,
+			"Path":         job.path,
+		}).Debug("Sync job is already pending")
+		return
+	}
+	lj.pending[key] = true
+	lj.jobs = append(lj.jobs, job)
+	select {
+	case lj.notify <- struct{}{}:
+	default:
+	}
+}
+
+// nextLocal removes the first job from the queue and clears its pending
+// marker.
+func (sq *SyncQueue) nextLocal() (localJob, bool) {
+	lj := &sq.local
+	lj.lock.Lock()
+	defer lj.lock.Unlock()
+	if len(lj.jobs) == 0 {
+		return localJob{}, false
+	}
+	job := lj.jobs[0]
+	lj.jobs = lj.jobs[1:]
+	delete(lj.pending, getPendingJobKey(job.name, job.path))
+	if len(lj.jobs) > 0 {
+		// Wake up another worker for the remaining jobs.
+		select {
+		case lj.notify <- struct{}{}:
+		default:
+		}
+	}
+	return job, true
+}
+
+// runLocal processes the jobs of a queue without redis until ctx is done.
+func (sq *SyncQueue) runLocal(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < sq.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, ok := sq.nextLocal()
+				if !ok {
+					select {
+					case <-ctx.Done():
+						return
+					case <-sq.local.notify:
+					}
+					continue
+				}
+				sq.processLocal(ctx, job)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (sq *SyncQueue) processLocal(ctx context.Context, job localJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			sq.log.Errorf("Recovered from panic: %s", r)
+		}
+	}()
+
+	job.deliveries++
+	if sq.sync(ctx, job.name, job.path) {
+		return
+	}
+	if job.deliveries >= maxJobDeliveries {
+		sq.log.WithFields(logrus.Fields{
+			"Synchronizer": job.name,
+			"Path":         job.path,
+		}).Error("Sync job failed too often and is dropped.")
+		return
+	}
+	time.AfterFunc(sq.visibility, func() {
+		sq.enqueueLocal(job)
+	})
+}
@@ -0,0 +1,97 @@
+package research
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// failingProvider is a provider whose listings fail, and counts them.
+type failingProvider struct {
+	*LocalProvider
+	lock  sync.Mutex
+	lists int
+}
+
+func (fp *failingProvider) List(ctx context.Context, p string, cursor string, recursive bool) ([]*StorageEntry, string, error) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	fp.lists++
+	return nil, cursor, errors.New("listing failed")
+}
+
+func (fp *failingProvider) listCount() int {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	return fp.lists
+}
+
+func newFailingSynchronizer() (*FolderSynchronizer, *failingProvider) {
+	log := newTestLogger()
+	fp := &failingProvider{LocalProvider: NewLocalProvider("", "")}
+	cb := NewCloudFileBuilder(fp, "", NewExtractorChain(), 0, 1, log)
+	return NewFolderSynchronizer(false, 1, cb, DummyCloudFileSyncer{}, NewMemoryStateStore(), log), fp
+}
+
+func TestSyncQueueCoalescesPendingJobs(t *testing.T) {
+	fs, _ := newFailingSynchronizer()
+	sq := NewSyncQueue(nil, 1, 0, newTestLogger())
+	ctx := context.Background()
+
+	for _, path := range []string{"/papers", "/Papers", "/papers", "/other"} {
+		if err := sq.Enqueue(ctx, fs, path); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+	if jobs := sq.local.jobs; len(jobs) != 2 || jobs[0].path != "/papers" || jobs[1].path != "/other" {
+		t.Fatalf("jobs = %v, want one job for /papers and one for /other", jobs)
+	}
+
+	// Once a job has been taken, notifications need a new job.
+	if job, ok := sq.nextLocal(); !ok || job.path != "/papers" {
+		t.Fatalf("nextLocal = %v, %v, want the job for /papers", job, ok)
+	}
+	if err := sq.Enqueue(ctx, fs, "/papers"); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if jobs := sq.local.jobs; len(jobs) != 2 || jobs[1].path != "/papers" {
+		t.Errorf("jobs = %v, want a new job for /papers", jobs)
+	}
+}
+
+func TestSyncQueueDropsFailingJobs(t *testing.T) {
+	fs, fp := newFailingSynchronizer()
+	sq := NewSyncQueue(nil, 1, time.Millisecond, newTestLogger())
+	sq.Register(fs)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sq.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := sq.Enqueue(ctx, fs, "/papers"); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fp.listCount() < maxJobDeliveries && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// A job that is retried once more would be delivered within this time.
+	time.Sleep(50 * time.Millisecond)
+	if lists := fp.listCount(); lists != maxJobDeliveries {
+		t.Errorf("job was delivered %d times, want %d", lists, maxJobDeliveries)
+	}
+	sq.local.lock.Lock()
+	defer sq.local.lock.Unlock()
+	if len(sq.local.jobs) != 0 || len(sq.local.pending) != 0 {
+		t.Errorf("jobs = %v, pending = %v, want the job dropped", sq.local.jobs, sq.local.pending)
+	}
+}
@@ -0,0 +1,348 @@
+package research
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shayanh/notionify/notionclient"
+	"github.com/sirupsen/logrus"
+)
+
+// MatchKind is how a file has been matched to its Notion page.
+type MatchKind string
+
+const (
+	// MatchFileID is a page that the state already maps the file to.
+	MatchFileID MatchKind = "file-id"
+	// MatchSourceID is the page whose source ID property names the file.
+	MatchSourceID MatchKind = "source-id"
+	// MatchURL is the only page whose URL is the share link of the file.
+	MatchURL MatchKind = "url"
+	// MatchTitle is the only page whose name is the file name.
+	MatchTitle MatchKind = "title"
+)
+
+// matchRank orders the kinds of matches from the most to the least reliable.
+var matchRank = map[MatchKind]int{
+	MatchFileID:   0,
+	MatchSourceID: 1,
+	MatchURL:      2,
+	MatchTitle:    3,
+}
+
+// ReconcileMatch is a file and the page it has been matched to.
+type ReconcileMatch struct {
+	Path   string
+	FileID string
+	PageID string
+	By     MatchKind
+}
+
+// ReconcileConflict is a file that could not be matched unambiguously. Its
+// mapping is left untouched.
+type ReconcileConflict struct {
+	Path    string
+	FileID  string
+	PageIDs []string
+	Reason  string
+}
+
+// ReconcileReport is the result of a reconciliation.
+type ReconcileReport struct {
+	Matches   []ReconcileMatch
+	Conflicts []ReconcileConflict
+	// Unmatched are the paths of files without a page. They get a new page
+	// when they are synchronized.
+	Unmatched []string
+	// Orphans are the IDs of pages that no file has been matched to.
+	Orphans []string
+	// Stale are the paths of files that the state maps to a page which is not
+	// in the database anymore.
+	Stale []string
+}
+
+// Reconciler rebuilds the mapping between the files of a FolderSynchronizer
+// and the pages of its Notion database, e.g. after the state has been lost.
+// Without it, every file would get a second page on its next
+// synchronization.
+type Reconciler struct {
+	fs  *FolderSynchronizer
+	nh  *NotionHandler
+	log *logrus.Logger
+}
+
+func NewReconciler(fs *FolderSynchronizer, nh *NotionHandler, log *logrus.Logger) *Reconciler {
+	return &Reconciler{
+		fs:  fs,
+		nh:  nh,
+		log: log,
+	}
+}
+
+// reconcileCandidate is a page that a file may belong to.
+type reconcileCandidate struct {
+	entry *StorageEntry
+	page  *NotionPage
+	by    MatchKind
+}
+
+// fileTitle is the title that a file is named after when no other title has
+// been extracted.
+func fileTitle(p string) string {
+	base := path.Base(p)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Reconcile matches the files below root to the pages of the database. A file
+// is matched to the page that the state maps it to, otherwise to the page
+// with its source ID, otherwise to the only page with its existing share link
+// as URL, otherwise to the only page named after the file. Pages that match
+// several files are reported as conflicts, unless one file matches them more
+// reliably than the others.
+//
+// Unless dryRun is set, the mappings of the matched files are written to the
+// state. Nothing is changed in a dry run, and no share links are created.
+func (r *Reconciler) Reconcile(ctx context.Context, root string, dryRun bool) (*ReconcileReport, error) {
+	r.fs.lock.Lock()
+	defer r.fs.lock.Unlock()
+
+	// Synchronizations in other processes must not write the mappings
+	// concurrently.
+	release, err := r.fs.ss.Lock(ctx, r.fs.getCursorKey(root), syncLockTTL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reconcile failed")
+	}
+	defer release()
+
+	if !dryRun {
+		if err := r.fs.migrateKeys(ctx, root); err != nil {
+			return nil, errors.Wrap(err, "Reconcile failed")
+		}
+	}
+
+	sp := r.fs.cb.Provider()
+	ss := r.fs.ss
+
+	pages, err := r.nh.ListPages(ctx)
+	if notionclient.IsMalformed(err) {
+		r.log.Warn(err)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Reconcile failed")
+	}
+	listing, _, err := sp.List(ctx, root, "", r.fs.recursive)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reconcile failed")
+	}
+	var files []*StorageEntry
+	for _, entry := range listing {
+		if entry.Kind == EntryFile {
+			files = append(files, entry)
+		}
+	}
+
+	byID := make(map[string]*NotionPage)
+	bySourceID := make(map[string][]*NotionPage)
+	byURL := make(map[string][]*NotionPage)
+	byTitle := make(map[string][]*NotionPage)
+	for _, page := range pages {
+		byID[page.ID] = page
+		if page.SourceID != "" {
+			bySourceID[page.SourceID] = append(bySourceID[page.SourceID], page)
+		}
+		if page.URL != "" {
+			byURL[page.URL] = append(byURL[page.URL], page)
+		}
+		if page.Name != "" {
+			title := strings.ToLower(strings.TrimSpace(page.Name))
+			byTitle[title] = append(byTitle[title], page)
+		}
+	}
+
+	report := &ReconcileReport{}
+	var candidates []reconcileCandidate
+	var unlinked []*StorageEntry
+	for _, entry := range files {
+		c := CloudFile{Provider: sp.Name(), Namespace: r.fs.cb.Namespace(), FileID: entry.ID}
+		pageID, err := ss.Get(ctx, c.GetKey())
+		if err != nil && err != ErrStateNotFound {
+			return nil, errors.Wrap(err, "Reconcile failed")
+		}
+		if page, ok := byID[pageID]; ok {
+			candidates = append(candidates, reconcileCandidate{entry, page, MatchFileID})
+			continue
+		}
+		if err == nil {
+			report.Stale = append(report.Stale, entry.Path)
+		}
+		// Pages created twice for the same file have the same source ID. The
+		// first one listed is kept, which is the oldest if the database has a
+		// created time property.
+		if matches := bySourceID[c.SourceID()]; len(matches) > 0 {
+			candidates = append(candidates, reconcileCandidate{entry, matches[0], MatchSourceID})
+			continue
+		}
+		unlinked = append(unlinked, entry)
+	}
+
+	links := r.shareLinks(ctx, sp, unlinked)
+	for _, entry := range unlinked {
+		if link := links[entry.ID]; link != "" {
+			if matches := byURL[link]; len(matches) == 1 {
+				candidates = append(candidates, reconcileCandidate{entry, matches[0], MatchURL})
+				continue
+			} else if len(matches) > 1 {
+				report.Conflicts = append(report.Conflicts, newReconcileConflict(entry, matches, "several pages have the URL of the file"))
+				continue
+			}
+		}
+		matches := byTitle[strings.ToLower(fileTitle(entry.Path))]
+		switch {
+		case len(matches) == 1:
+			candidates = append(candidates, reconcileCandidate{entry, matches[0], MatchTitle})
+		case len(matches) > 1:
+			report.Conflicts = append(report.Conflicts, newReconcileConflict(entry, matches, "several pages are named after the file"))
+		default:
+			report.Unmatched = append(report.Unmatched, entry.Path)
+		}
+	}
+
+	// A page belongs to the file that matches it most reliably. Files that
+	// match it equally well are conflicts.
+	claims := make(map[string][]reconcileCandidate)
+	for _, candidate := range candidates {
+		claims[candidate.page.ID] = append(claims[candidate.page.ID], candidate)
+	}
+	matched := make(map[string]bool)
+	for pageID, claimed := range claims {
+		sort.SliceStable(claimed, func(i, j int) bool {
+			return matchRank[claimed[i].by] < matchRank[claimed[j].by]
+		})
+		winners := 1
+		for winners < len(claimed) && claimed[winners].by == claimed[0].by {
+			winners++
+		}
+		for i, candidate := range claimed {
+			if i == 0 && winners == 1 {
+				continue
+			}
+			report.Conflicts = append(report.Conflicts, newReconcileConflict(candidate.entry, []*NotionPage{candidate.page}, "page matches several files"))
+		}
+		if winners > 1 {
+			continue
+		}
+		matched[pageID] = true
+		report.Matches = append(report.Matches, ReconcileMatch{
+			Path:   claimed[0].entry.Path,
+			FileID: claimed[0].entry.ID,
+			PageID: pageID,
+			By:     claimed[0].by,
+		})
+	}
+	for _, page := range pages {
+		if !matched[page.ID] {
+			report.Orphans = append(report.Orphans, page.ID)
+		}
+	}
+	sort.Slice(report.Matches, func(i, j int) bool {
+		return report.Matches[i].Path < report.Matches[j].Path
+	})
+	sort.Slice(report.Conflicts, func(i, j int) bool {
+		return report.Conflicts[i].Path < report.Conflicts[j].Path
+	})
+
+	for _, conflict := range report.Conflicts {
+		r.log.WithFields(logrus.Fields{
+			"Path":    conflict.Path,
+			"FileID":  conflict.FileID,
+			"PageIDs": conflict.PageIDs,
+		}).Warn("Reconcile conflict: " + conflict.Reason)
+	}
+	for _, match := range report.Matches {
+		r.log.WithFields(logrus.Fields{
+			"Path":   match.Path,
+			"FileID": match.FileID,
+			"PageID": match.PageID,
+			"By":     match.By,
+			"DryRun": dryRun,
+		}).Info("Cloud file matched.")
+		if dryRun {
+			continue
+		}
+		c := CloudFile{
+			Provider:  sp.Name(),
+			Namespace: r.fs.cb.Namespace(),
+			FileID:    match.FileID,
+			Path:      match.Path,
+		}
+		if err := r.save(ctx, c, byID[match.PageID]); err != nil {
+			return report, errors.Wrap(err, "Reconcile failed")
+		}
+	}
+	return report, nil
+}
+
+// shareLinks returns the existing links of entries by entry ID. Links are
+// not created, since a new link cannot be the URL of a page. Entries whose
+// link cannot be looked up are left out, so they can still be matched by
+// title.
+func (r *Reconciler) shareLinks(ctx context.Context, sp StorageProvider, entries []*StorageEntry) map[string]string {
+	if lf, ok := sp.(LinkFinder); ok {
+		links, err := lf.FindShareLinks(ctx, entries)
+		if err != nil {
+			r.log.Warn(err)
+		}
+		if links == nil {
+			links = make(map[string]string)
+		}
+		return links
+	}
+	// Links of other providers are computed without side effects.
+	links := make(map[string]string)
+	for _, entry := range entries {
+		link, err := sp.ShareLink(ctx, entry)
+		if err != nil {
+			r.log.WithField("Path", entry.Path).Warn(err)
+			continue
+		}
+		links[entry.ID] = link
+	}
+	return links
+}
+
+// save writes the mapping of a matched file, and indexes the content hash
+// recorded on its page. The last written title is not restored, so a page
+// name that has been edited in Notion is kept.
+func (r *Reconciler) save(ctx context.Context, c CloudFile, page *NotionPage) error {
+	ss := r.fs.ss
+	set := map[string]string{
+		c.GetKey():         page.ID,
+		c.GetPathKey():     c.FileID,
+		c.GetLastPathKey(): c.Path,
+	}
+	if page.ContentHash != "" {
+		set[c.GetContentHashKey()] = page.ContentHash
+		indexKey := getHashIndexKey(c.keySpace(), page.ContentHash)
+		if _, err := ss.Get(ctx, indexKey); err == ErrStateNotFound {
+			set[indexKey] = page.ID
+		} else if err != nil {
+			return err
+		}
+	}
+	return ss.Apply(ctx, set, nil)
+}
+
+func newReconcileConflict(entry *StorageEntry, pages []*NotionPage, reason string) ReconcileConflict {
+	conflict := ReconcileConflict{
+		Path:   entry.Path,
+		FileID: entry.ID,
+		Reason: reason,
+	}
+	for _, page := range pages {
+		conflict.PageIDs = append(conflict.PageIDs, page.ID)
+	}
+	return conflict
+}
@@ -0,0 +1,136 @@
+package research
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStateStore is a StateStore in redis. Hashes are redis hashes, and
+// locks are keys with an expiry, so they are shared between processes.
+type RedisStateStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisStateStore(rdb *redis.Client) *RedisStateStore {
+	return &RedisStateStore{
+		rdb: rdb,
+	}
+}
+
+// Client returns the redis client of the store.
+func (rs *RedisStateStore) Client() *redis.Client {
+	return rs.rdb
+}
+
+func (rs *RedisStateStore) Get(ctx context.Context, key string) (string, error) {
+	value, err := rs.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrStateNotFound
+	}
+	return value, err
+}
+
+func (rs *RedisStateStore) Set(ctx context.Context, key string, value string) error {
+	return rs.rdb.Set(ctx, key, value, 0).Err()
+}
+
+func (rs *RedisStateStore) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return rs.rdb.Del(ctx, keys...).Err()
+}
+
+func (rs *RedisStateStore) Apply(ctx context.Context, set map[string]string, del []string) error {
+	_, err := rs.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(del) > 0 {
+			pipe.Del(ctx, del...)
+		}
+		for key, value := range set {
+			pipe.Set(ctx, key, value, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+// globEscaper escapes the characters of a key that are special in the
+// patterns of SCAN, e.g. the brackets in a path like "/[draft] paper.pdf".
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Keys only scans string keys, so that hashes are left out like in the other
+// stores. Scanning by type requires Redis 6.
+func (rs *RedisStateStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	iter := rs.rdb.ScanType(ctx, 0, globEscaper.Replace(prefix)+"*", 1000, "string").Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+func (rs *RedisStateStore) GetField(ctx context.Context, key string, field string) (string, error) {
+	value, err := rs.rdb.HGet(ctx, key, field).Result()
+	if err == redis.Nil {
+		return "", ErrStateNotFound
+	}
+	return value, err
+}
+
+func (rs *RedisStateStore) SetField(ctx context.Context, key string, field string, value string) error {
+	return rs.rdb.HSet(ctx, key, field, value).Err()
+}
+
+func (rs *RedisStateStore) DeleteField(ctx context.Context, key string, field string) (bool, error) {
+	n, err := rs.rdb.HDel(ctx, key, field).Result()
+	return n > 0, err
+}
+
+func (rs *RedisStateStore) Fields(ctx context.Context, key string) (map[string]string, error) {
+	return rs.rdb.HGetAll(ctx, key).Result()
+}
+
+// releaseLock deletes a lock only if it still holds the token of its owner.
+var releaseLock = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// extendLock resets the expiry of a lock only if it still holds the token of
+// its owner.
+var extendLock = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+func (rs *RedisStateStore) Lock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+	key := "lock-" + name
+	ok, err := rs.rdb.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+	stop := keepAlive(ttl/3, func() {
+		extendLock.Run(context.Background(), rs.rdb, []string{key}, token, ttl.Milliseconds())
+	})
+	return func() {
+		stop()
+		releaseLock.Run(context.Background(), rs.rdb, []string{key}, token)
+	}, nil
+}
@@ -0,0 +1,263 @@
+package research
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrMetadataNotFound = errors.New("metadata not found")
+
+// PaperID identifies a paper by its DOI or arXiv identifier.
+type PaperID struct {
+	DOI     string
+	ArXivID string
+}
+
+func (id PaperID) IsZero() bool {
+	return id.DOI == "" && id.ArXivID == ""
+}
+
+// Metadata is the canonical bibliographic metadata of a paper.
+type Metadata struct {
+	Title   string   `json:"title"`
+	Authors []string `json:"authors"`
+	Year    int      `json:"year"`
+	Venue   string   `json:"venue"`
+	DOI     string   `json:"doi"`
+	ArXivID string   `json:"arxiv"`
+}
+
+// MetadataResolver resolves a paper identifier to its metadata. It returns
+// ErrMetadataNotFound if the paper is unknown.
+type MetadataResolver interface {
+	Resolve(ctx context.Context, id PaperID) (*Metadata, error)
+}
+
+// MultiResolver tries its resolvers in order and returns the first match.
+type MultiResolver []MetadataResolver
+
+func (mr MultiResolver) Resolve(ctx context.Context, id PaperID) (*Metadata, error) {
+	for _, resolver := range mr {
+		md, err := resolver.Resolve(ctx, id)
+		if err == ErrMetadataNotFound {
+			continue
+		}
+		return md, err
+	}
+	return nil, ErrMetadataNotFound
+}
+
+// ResolverExtractor fills in the canonical metadata of files whose DOI or
+// arXiv identifier has been extracted.
+type ResolverExtractor struct {
+	resolver MetadataResolver
+}
+
+func NewResolverExtractor(resolver MetadataResolver) *ResolverExtractor {
+	return &ResolverExtractor{resolver: resolver}
+}
+
+func (re *ResolverExtractor) Extract(ctx context.Context, src *Source, c *CloudFile) error {
+	id := PaperID{DOI: c.DOI, ArXivID: c.ArXivID}
+	if id.IsZero() {
+		return nil
+	}
+	md, err := re.resolver.Resolve(ctx, id)
+	if err == ErrMetadataNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "metadata resolution failed")
+	}
+	if md.Title != "" {
+		c.Title = md.Title
+	}
+	if len(md.Authors) > 0 {
+		c.Authors = md.Authors
+	}
+	if md.Year != 0 {
+		c.Year = md.Year
+	}
+	if md.Venue != "" {
+		c.Venue = md.Venue
+	}
+	if c.DOI == "" && md.DOI != "" {
+		c.DOI = NormalizeDOI(md.DOI)
+	}
+	if c.ArXivID == "" && md.ArXivID != "" {
+		c.ArXivID = md.ArXivID
+	}
+	return nil
+}
+
+// FileResolver resolves identifiers from a local BibTeX (.bib) or JSON file.
+// A JSON file holds an array of Metadata objects.
+type FileResolver struct {
+	byDOI   map[string]*Metadata
+	byArXiv map[string]*Metadata
+}
+
+func NewFileResolver(path string) (*FileResolver, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "file resolver failed")
+	}
+	var entries []*Metadata
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".bib":
+		entries = ParseBibTeX(string(data))
+	case ".json":
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, errors.Wrap(err, "file resolver failed")
+		}
+	default:
+		return nil, errors.Errorf("file resolver: unsupported file %q", path)
+	}
+
+	fr := &FileResolver{
+		byDOI:   make(map[string]*Metadata),
+		byArXiv: make(map[string]*Metadata),
+	}
+	for _, md := range entries {
+		if md.DOI != "" {
+			fr.byDOI[NormalizeDOI(md.DOI)] = md
+		}
+		if md.ArXivID != "" {
+			fr.byArXiv[strings.ToLower(md.ArXivID)] = md
+		}
+	}
+	return fr, nil
+}
+
+func (fr *FileResolver) Resolve(ctx context.Context, id PaperID) (*Metadata, error) {
+	if md, ok := fr.byDOI[NormalizeDOI(id.DOI)]; ok && id.DOI != "" {
+		return md, nil
+	}
+	if md, ok := fr.byArXiv[strings.ToLower(id.ArXivID)]; ok && id.ArXivID != "" {
+		return md, nil
+	}
+	return nil, ErrMetadataNotFound
+}
+
+// HTTPResolver resolves identifiers through DOI content negotiation, which
+// returns CSL JSON. arXiv identifiers are resolved through their DataCite
+// DOIs.
+type HTTPResolver struct {
+	baseURL string
+	client  *http.Client
+}
+
+// defaultResolverTimeout bounds the requests of an HTTPResolver when no
+// timeout is given, so that a stalled server does not block extraction.
+const defaultResolverTimeout = 10 * time.Second
+
+// NewHTTPResolver returns a resolver that requests the DOI below baseURL,
+// e.g. https://doi.org. Requests time out after timeout, or after
+// defaultResolverTimeout if it is not positive.
+func NewHTTPResolver(baseURL string, timeout time.Duration) *HTTPResolver {
+	if timeout <= 0 {
+		timeout = defaultResolverTimeout
+	}
+	return &HTTPResolver{
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+const cslJSONMediaType = "application/vnd.citationstyles.csl+json"
+
+// cslItem is the subset of a CSL JSON item that we use.
+type cslItem struct {
+	Title  json.RawMessage `json:"title"`
+	Author []struct {
+		Given   string `json:"given"`
+		Family  string `json:"family"`
+		Literal string `json:"literal"`
+	} `json:"author"`
+	Issued struct {
+		DateParts [][]json.Number `json:"date-parts"`
+	} `json:"issued"`
+	ContainerTitle json.RawMessage `json:"container-title"`
+	Publisher      string          `json:"publisher"`
+	DOI            string          `json:"DOI"`
+}
+
+// cslString decodes CSL fields that are either a string or an array of
+// strings.
+func cslString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil && len(list) > 0 {
+		return list[0]
+	}
+	return ""
+}
+
+func (hr *HTTPResolver) Resolve(ctx context.Context, id PaperID) (*Metadata, error) {
+	doi := id.DOI
+	if doi == "" {
+		doi = "10.48550/arXiv." + id.ArXivID
+	}
+	u, err := url.Parse(hr.baseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "http resolver failed")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + doi
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "http resolver failed")
+	}
+	req.Header.Set("Accept", cslJSONMediaType)
+
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "http resolver failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrMetadataNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode, "http resolver: unexpected status %s", resp.Status)
+	}
+
+	var item cslItem
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, errors.Wrap(err, "http resolver failed")
+	}
+	md := &Metadata{
+		Title:   cslString(item.Title),
+		Venue:   cslString(item.ContainerTitle),
+		DOI:     item.DOI,
+		ArXivID: id.ArXivID,
+	}
+	if md.Venue == "" {
+		md.Venue = item.Publisher
+	}
+	for _, author := range item.Author {
+		name := strings.TrimSpace(author.Given + " " + author.Family)
+		if author.Literal != "" {
+			name = author.Literal
+		}
+		if name != "" {
+			md.Authors = append(md.Authors, name)
+		}
+	}
+	if len(item.Issued.DateParts) > 0 && len(item.Issued.DateParts[0]) > 0 {
+		year, _ := strconv.Atoi(item.Issued.DateParts[0][0].String())
+		md.Year = year
+	}
+	return md, nil
+}
@@ -0,0 +1,102 @@
+package research
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const attentionCSL = `{
+	"title": "Attention Is All You Need",
+	"author": [
+		{"given": "Ashish", "family": "Vaswani"},
+		{"literal": "Google Brain"}
+	],
+	"issued": {"date-parts": [[2017, 6, 12]]},
+	"container-title": ["Advances in Neural Information Processing Systems"],
+	"publisher": "Curran Associates",
+	"DOI": "10.48550/arXiv.1706.03762"
+}`
+
+func TestHTTPResolver(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get("Accept") != cslJSONMediaType {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		switch r.URL.Path {
+		case "/10.48550/arXiv.1706.03762":
+			w.Header().Set("Content-Type", cslJSONMediaType)
+			w.Write([]byte(attentionCSL))
+		case "/10.1000/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	hr := NewHTTPResolver(server.URL+"/", time.Second)
+	ctx := context.Background()
+
+	md, err := hr.Resolve(ctx, PaperID{ArXivID: "1706.03762"})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	want := &Metadata{
+		Title:   "Attention Is All You Need",
+		Authors: []string{"Ashish Vaswani", "Google Brain"},
+		Year:    2017,
+		Venue:   "Advances in Neural Information Processing Systems",
+		DOI:     "10.48550/arXiv.1706.03762",
+		ArXivID: "1706.03762",
+	}
+	if !reflect.DeepEqual(md, want) {
+		t.Errorf("Resolve = %+v, want %+v", md, want)
+	}
+	if len(paths) != 1 || paths[0] != "/10.48550/arXiv.1706.03762" {
+		t.Errorf("requested %v, want the DataCite DOI of the arXiv identifier", paths)
+	}
+
+	if _, err := hr.Resolve(ctx, PaperID{DOI: "10.1000/unknown"}); err != ErrMetadataNotFound {
+		t.Errorf("Resolve of an unknown DOI = %v, want ErrMetadataNotFound", err)
+	}
+	_, err = hr.Resolve(ctx, PaperID{DOI: "10.1000/unavailable"})
+	if err == nil || err == ErrMetadataNotFound || !isTransient(err) {
+		t.Errorf("Resolve of an unavailable DOI = %v, want a transient error", err)
+	}
+}
+
+func TestResolverExtractor(t *testing.T) {
+	fr := &FileResolver{
+		byDOI: map[string]*Metadata{
+			"10.1000/paper": {Title: "Canonical", Year: 2020, ArXivID: "2001.00001"},
+		},
+		byArXiv: map[string]*Metadata{},
+	}
+	re := NewResolverExtractor(MultiResolver{fr})
+	ctx := context.Background()
+
+	c := &CloudFile{Title: "extracted", DOI: "10.1000/paper"}
+	if err := re.Extract(ctx, nil, c); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if c.Title != "Canonical" || c.Year != 2020 || c.ArXivID != "2001.00001" {
+		t.Errorf("Extract = %+v, want the resolved metadata", c)
+	}
+
+	c = &CloudFile{Title: "extracted", DOI: "10.1000/other"}
+	if err := re.Extract(ctx, nil, c); err != nil || c.Title != "extracted" {
+		t.Errorf("Extract of an unknown paper = %v, %+v, want the file unchanged", err, c)
+	}
+}
+
+func TestHTTPResolverDefaultTimeout(t *testing.T) {
+	if timeout := NewHTTPResolver("https://doi.org", 0).client.Timeout; timeout != defaultResolverTimeout {
+		t.Errorf("timeout = %v, want %v", timeout, defaultResolverTimeout)
+	}
+}
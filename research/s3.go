@@ -0,0 +1,497 @@
+package research
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const s3Provider = "s3"
+
+// S3Options configures an S3Provider.
+type S3Options struct {
+	// Endpoint is the base URL of the service, e.g. http://localhost:9000.
+	// Buckets are addressed path-style.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PublicURL builds the share link of an object by replacing {bucket}
+	// and {key}. Presigned URLs valid for PresignExpiry are used when it is
+	// empty. They are renewed before they expire as long as the folder is
+	// listed every LinkRefreshInterval.
+	PublicURL     string
+	PresignExpiry time.Duration
+}
+
+// S3Provider is a StorageProvider for a bucket of an S3-compatible object
+// storage such as MinIO. Object keys map to paths by prepending a slash. S3
+// has no change feed, so its cursor is a snapshot of the ETags of the
+// previous listing.
+type S3Provider struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3Provider(opts S3Options) (*S3Provider, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid s3 endpoint")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	const maxPresignExpiry = 7 * 24 * time.Hour
+	if opts.PresignExpiry <= 0 || opts.PresignExpiry > maxPresignExpiry {
+		opts.PresignExpiry = maxPresignExpiry
+	}
+	return &S3Provider{
+		opts:     opts,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}, nil
+}
+
+func (s3 *S3Provider) Name() string {
+	return s3Provider
+}
+
+func s3Key(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func (s3 *S3Provider) objectURL(key string) *url.URL {
+	u := *s3.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s3.opts.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	return &u
+}
+
+// s3FileID derives an ID for an object from its key. Moved objects keep their
+// original ID through the snapshot.
+func s3FileID(entry *StorageEntry) string {
+	sum := sha1.Sum([]byte(entry.Path))
+	return hex.EncodeToString(sum[:10])
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List lists the objects below p page by page, following continuation
+// tokens, and diffs them against the snapshot stored in cursor.
+func (s3 *S3Provider) List(ctx context.Context, p string, cursor string, recursive bool) ([]*StorageEntry, string, error) {
+	prev, err := decodeSnapshot(cursor)
+	if err != nil {
+		return nil, cursor, errors.Wrap(err, "s3 List failed")
+	}
+
+	prefix := s3Key(p)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var listing []*StorageEntry
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if !recursive {
+			query.Set("delimiter", "/")
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := s3.objectURL("")
+		u.RawQuery = query.Encode()
+		resp, err := s3.do(ctx, http.MethodGet, u, nil, 0)
+		if err != nil {
+			return nil, cursor, errors.Wrap(err, "s3 List failed")
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, cursor, errors.Wrap(err, "s3 List failed")
+		}
+		for _, object := range result.Contents {
+			if strings.HasSuffix(object.Key, "/") {
+				continue
+			}
+			listing = append(listing, &StorageEntry{
+				Kind:     EntryFile,
+				Path:     "/" + object.Key,
+				Size:     object.Size,
+				Rev:      strings.Trim(object.ETag, `"`),
+				Modified: object.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	entries, cur := diffListing(prev, listing, s3FileID)
+	if s3.opts.PublicURL == "" {
+		entries = s3.refreshLinks(prev, cur, listing, entries, time.Now())
+	}
+	newCursor, err := cur.encode()
+	if err != nil {
+		return nil, cursor, errors.Wrap(err, "s3 List failed")
+	}
+	return entries, newCursor, nil
+}
+
+// refreshLinks records when the presigned links of the files in cur expire,
+// and adds the unchanged files whose links expire soon to changes, so that
+// their pages get a new link. The links of changes are created right after
+// listing.
+func (s3 *S3Provider) refreshLinks(prev snapshot, cur snapshot, listing []*StorageEntry, changes []*StorageEntry, now time.Time) []*StorageEntry {
+	changed := make(map[string]bool)
+	for _, entry := range changes {
+		changed[entry.Path] = true
+	}
+	expires := now.Add(s3.opts.PresignExpiry).Unix()
+	refresh := now.Add(s3.opts.PresignExpiry / 4).Unix()
+	for _, entry := range listing {
+		snap := cur[entry.Path]
+		snap.LinkExpires = prev[entry.Path].LinkExpires
+		if !changed[entry.Path] && snap.LinkExpires < refresh {
+			changes = append(changes, entry)
+			changed[entry.Path] = true
+		}
+		if changed[entry.Path] {
+			snap.LinkExpires = expires
+		}
+		cur[entry.Path] = snap
+	}
+	return changes
+}
+
+// LinkRefreshInterval is how often the folders of the provider have to be
+// listed so that no presigned link expires, or zero if links do not expire.
+func (s3 *S3Provider) LinkRefreshInterval() time.Duration {
+	if s3.opts.PublicURL != "" {
+		return 0
+	}
+	return s3.opts.PresignExpiry / 12
+}
+
+func (s3 *S3Provider) GetMetadata(ctx context.Context, p string) (*StorageEntry, error) {
+	resp, err := s3.do(ctx, http.MethodHead, s3.objectURL(s3Key(p)), nil, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 GetMetadata failed")
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	entry := &StorageEntry{
+		Kind:     EntryFile,
+		Path:     "/" + s3Key(p),
+		Size:     resp.ContentLength,
+		Rev:      strings.Trim(resp.Header.Get("ETag"), `"`),
+		Modified: modified,
+	}
+	entry.ID = s3FileID(entry)
+	return entry, nil
+}
+
+func (s3 *S3Provider) ShareLink(ctx context.Context, entry *StorageEntry) (string, error) {
+	key := s3Key(entry.Path)
+	if s3.opts.PublicURL != "" {
+		return strings.NewReplacer(
+			"{bucket}", s3.opts.Bucket,
+			"{key}", awsURIEncode(key, false),
+		).Replace(s3.opts.PublicURL), nil
+	}
+	return s3.presign(s3.objectURL(key), time.Now()), nil
+}
+
+func (s3 *S3Provider) Download(ctx context.Context, entry *StorageEntry) (io.ReadCloser, error) {
+	resp, err := s3.do(ctx, http.MethodGet, s3.objectURL(s3Key(entry.Path)), nil, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 Download failed")
+	}
+	return resp.Body, nil
+}
+
+func (s3 *S3Provider) Upload(ctx context.Context, p string, content io.Reader) (*StorageEntry, error) {
+	// S3 needs the content length up front.
+	tmp, size, err := DownloadToTemp(content, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 Upload failed")
+	}
+	defer tmp.Close()
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "s3 Upload failed")
+	}
+	resp, err := s3.do(ctx, http.MethodPut, s3.objectURL(s3Key(p)), tmp, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 Upload failed")
+	}
+	resp.Body.Close()
+	return s3.GetMetadata(ctx, p)
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request and fails on non-2xx responses.
+func (s3 *S3Provider) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s3.sign(req, time.Now())
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var apiErr s3Error
+		if err := xml.NewDecoder(resp.Body).Decode(&apiErr); err == nil && apiErr.Code != "" {
+			return nil, newStatusError(resp.StatusCode, "s3: %s: %s", apiErr.Code, apiErr.Message)
+		}
+		return nil, newStatusError(resp.StatusCode, "s3: unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+const (
+	amzDateFormat   = "20060102T150405Z"
+	amzAlgorithm    = "AWS4-HMAC-SHA256"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// awsURIEncode encodes s as required by AWS Signature Version 4.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, ch := range []byte(s) {
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (s3 *S3Provider) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s3.opts.Region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request made at t.
+func (s3 *S3Provider) signature(t time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		amzAlgorithm,
+		t.Format(amzDateFormat),
+		s3.scope(t),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s3.opts.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s3.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sign adds an AWS Signature Version 4 authorization header to req. The
+// payload is not signed.
+func (s3 *S3Provider) sign(req *http.Request, now time.Time) {
+	t := now.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + unsignedPayload + "\n" +
+		"x-amz-date:" + t.Format(amzDateFormat) + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		amzAlgorithm, s3.opts.AccessKey, s3.scope(t), signedHeaders, s3.signature(t, canonicalRequest)))
+}
+
+// presign returns a GET URL for u that is valid for the configured expiry.
+func (s3 *S3Provider) presign(u *url.URL, now time.Time) string {
+	t := now.UTC()
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", amzAlgorithm)
+	query.Set("X-Amz-Credential", s3.opts.AccessKey+"/"+s3.scope(t))
+	query.Set("X-Amz-Date", t.Format(amzDateFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(s3.opts.PresignExpiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		awsURIEncode(u.Path, false),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	query.Set("X-Amz-Signature", s3.signature(t, canonicalRequest))
+
+	presigned := *u
+	presigned.RawPath = awsURIEncode(u.Path, false)
+	presigned.RawQuery = canonicalQuery(query)
+	return presigned.String()
+}
+
+// s3Event is a bucket notification in the format shared by S3 and MinIO.
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// S3EventHandler enqueues a synchronization of a folder of an S3Provider when
+// the bucket notifies about changes below it.
+type S3EventHandler struct {
+	bucket   string
+	rootPath string
+	token    string
+	fs       *FolderSynchronizer
+	sq       *SyncQueue
+	log      *logrus.Logger
+}
+
+// NewS3EventHandler returns a handler for the notifications of bucket.
+// Requests have to carry token as bearer token, which is how MinIO
+// authenticates its webhook targets.
+func NewS3EventHandler(bucket string, rootPath string, token string, fs *FolderSynchronizer, sq *SyncQueue, log *logrus.Logger) *S3EventHandler {
+	return &S3EventHandler{
+		bucket:   bucket,
+		rootPath: rootPath,
+		token:    token,
+		fs:       fs,
+		sq:       sq,
+		log:      log,
+	}
+}
+
+// affected reports whether the event changed an object below the root path.
+func (eh *S3EventHandler) affected(event *s3Event) bool {
+	prefix := s3Key(eh.rootPath)
+	for _, record := range event.Records {
+		if record.S3.Bucket.Name != eh.bucket {
+			continue
+		}
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			key = record.S3.Object.Key
+		}
+		if prefix == "" || strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (eh *S3EventHandler) handleEvent(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, eh.token) {
+		eh.log.Warn("S3 event authentication failed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		eh.log.Errorf("Error while reading event body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var event s3Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		eh.log.Errorf("Error while decoding event body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if eh.affected(&event) {
+		if err := eh.sq.Enqueue(r.Context(), eh.fs, eh.rootPath); err != nil {
+			eh.log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+func (eh *S3EventHandler) HandleFuncs(router *mux.Router) {
+	router.HandleFunc("", eh.handleEvent).Methods("POST")
+}
@@ -0,0 +1,130 @@
+package research
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotEntry is a file of a snapshot.
+type snapshotEntry struct {
+	ID   string `json:"id"`
+	Rev  string `json:"rev"`
+	Size int64  `json:"size"`
+	// LinkExpires is when the share link of the file expires, in Unix
+	// seconds, for providers whose links expire.
+	LinkExpires int64 `json:"linkExpires,omitempty"`
+	// Folder marks the entries of folders, which providers may keep to skip
+	// unchanged folders. They are ignored by diffListing.
+	Folder bool `json:"folder,omitempty"`
+}
+
+// snapshot is the state of a listing, keyed by path. Providers without a
+// change feed store it as their cursor and diff each listing against it.
+type snapshot map[string]snapshotEntry
+
+// below returns the files of snap below the folder dir, and adds the
+// revisions of its subfolders to folders.
+func (snap snapshot) below(dir string, folders map[string]string) []*StorageEntry {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	var entries []*StorageEntry
+	for p, old := range snap {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		if old.Folder {
+			folders[p] = old.Rev
+			continue
+		}
+		entries = append(entries, &StorageEntry{
+			Kind: EntryFile,
+			ID:   old.ID,
+			Path: p,
+			Rev:  old.Rev,
+			Size: old.Size,
+		})
+	}
+	return entries
+}
+
+func decodeSnapshot(cursor string) (snapshot, error) {
+	snap := make(snapshot)
+	if cursor == "" {
+		return snap, nil
+	}
+	if err := json.Unmarshal([]byte(cursor), &snap); err != nil {
+		return nil, errors.Wrap(err, "invalid snapshot cursor")
+	}
+	return snap, nil
+}
+
+func (snap snapshot) encode() (string, error) {
+	b, err := json.Marshal(snap)
+	return string(b), err
+}
+
+// diffListing compares the files of a full listing with the snapshot of the
+// previous listing. It returns the new and changed files, followed by the
+// deleted ones, and the snapshot of the listing.
+//
+// Files keep the ID recorded for their path. A new file that has the revision
+// of a file that disappeared is treated as a move and inherits its ID. Other
+// files without an ID get one from newID.
+func diffListing(prev snapshot, listing []*StorageEntry, newID func(*StorageEntry) string) ([]*StorageEntry, snapshot) {
+	cur := make(snapshot)
+	seen := make(map[string]bool)
+	for _, entry := range listing {
+		seen[entry.Path] = true
+	}
+	// Disappeared files by revision, for move detection.
+	moved := make(map[string][]string)
+	for path, old := range prev {
+		if !seen[path] && !old.Folder && old.Rev != "" {
+			moved[old.Rev] = append(moved[old.Rev], path)
+		}
+	}
+
+	var changes []*StorageEntry
+	for _, entry := range listing {
+		old, ok := prev[entry.Path]
+		switch {
+		case ok:
+			if entry.ID == "" {
+				entry.ID = old.ID
+			}
+		case len(moved[entry.Rev]) > 0 && entry.Rev != "":
+			from := moved[entry.Rev][0]
+			moved[entry.Rev] = moved[entry.Rev][1:]
+			if entry.ID == "" {
+				entry.ID = prev[from].ID
+			}
+		}
+		if entry.ID == "" {
+			entry.ID = newID(entry)
+		}
+		cur[entry.Path] = snapshotEntry{ID: entry.ID, Rev: entry.Rev, Size: entry.Size}
+		if !ok || old.Rev != entry.Rev || old.ID != entry.ID {
+			changes = append(changes, entry)
+		}
+	}
+
+	for path, old := range prev {
+		if !seen[path] && !old.Folder {
+			changes = append(changes, &StorageEntry{
+				Kind: EntryDeleted,
+				Path: path,
+			})
+		}
+	}
+	return changes, cur
+}
+
+// shortCursor shortens a cursor for logging. Snapshot cursors can be large.
+func shortCursor(cursor string) string {
+	const max = 64
+	if len(cursor) <= max {
+		return cursor
+	}
+	return strings.TrimSpace(cursor[:max]) + "..."
+}
@@ -0,0 +1,219 @@
+package research
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrStateNotFound = errors.New("state not found")
+	ErrLocked        = errors.New("state is locked")
+)
+
+// StateStore keeps the state of the synchronization: cursors, the mappings
+// between files and Notion pages, dead letters and locks. Values are
+// addressed by key, and hashes by key and field.
+type StateStore interface {
+	// Get returns the value of key, or ErrStateNotFound.
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string) error
+	// Delete deletes keys, including hashes.
+	Delete(ctx context.Context, keys ...string) error
+	// Apply sets and deletes keys atomically. Like Delete, it deletes hashes
+	// too.
+	Apply(ctx context.Context, set map[string]string, del []string) error
+	// Keys returns the keys that start with prefix. Hashes are not included.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+
+	// GetField returns a field of the hash key, or ErrStateNotFound.
+	GetField(ctx context.Context, key string, field string) (string, error)
+	SetField(ctx context.Context, key string, field string, value string) error
+	// DeleteField reports whether the field existed.
+	DeleteField(ctx context.Context, key string, field string) (bool, error)
+	// Fields returns all fields of the hash key.
+	Fields(ctx context.Context, key string) (map[string]string, error)
+
+	// Lock acquires the lock name, or fails with ErrLocked. The lock is
+	// renewed while it is held, and expires ttl after its holder stopped
+	// renewing it, e.g. because the process crashed. The returned function
+	// releases it.
+	Lock(ctx context.Context, name string, ttl time.Duration) (func(), error)
+}
+
+// keepAlive calls renew every interval until the returned function is
+// called.
+func keepAlive(interval time.Duration, renew func()) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renew()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// localLocks are locks that are only shared within the process.
+type localLocks struct {
+	held map[string]*localLock
+	lock sync.Mutex
+}
+
+type localLock struct {
+	expiry time.Time
+}
+
+func (ll *localLocks) acquire(name string, ttl time.Duration) (func(), error) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	if ll.held == nil {
+		ll.held = make(map[string]*localLock)
+	}
+	now := time.Now()
+	if held, ok := ll.held[name]; ok && held.expiry.After(now) {
+		return nil, ErrLocked
+	}
+	l := &localLock{expiry: now.Add(ttl)}
+	ll.held[name] = l
+	stop := keepAlive(ttl/3, func() {
+		ll.lock.Lock()
+		defer ll.lock.Unlock()
+		if ll.held[name] == l {
+			l.expiry = time.Now().Add(ttl)
+		}
+	})
+	return func() {
+		stop()
+		ll.lock.Lock()
+		defer ll.lock.Unlock()
+		// The lock may have expired and been taken by someone else.
+		if ll.held[name] == l {
+			delete(ll.held, name)
+		}
+	}, nil
+}
+
+// MemoryStateStore is a StateStore that keeps the state in memory. The state
+// is lost when the process exits.
+type MemoryStateStore struct {
+	values map[string]string
+	hashes map[string]map[string]string
+	locks  localLocks
+	lock   sync.RWMutex
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		values: make(map[string]string),
+		hashes: make(map[string]map[string]string),
+	}
+}
+
+func (ms *MemoryStateStore) Get(ctx context.Context, key string) (string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	value, ok := ms.values[key]
+	if !ok {
+		return "", ErrStateNotFound
+	}
+	return value, nil
+}
+
+func (ms *MemoryStateStore) Set(ctx context.Context, key string, value string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.values[key] = value
+	return nil
+}
+
+func (ms *MemoryStateStore) Delete(ctx context.Context, keys ...string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, key := range keys {
+		delete(ms.values, key)
+		delete(ms.hashes, key)
+	}
+	return nil
+}
+
+func (ms *MemoryStateStore) Apply(ctx context.Context, set map[string]string, del []string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, key := range del {
+		delete(ms.values, key)
+		delete(ms.hashes, key)
+	}
+	for key, value := range set {
+		ms.values[key] = value
+	}
+	return nil
+}
+
+func (ms *MemoryStateStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	var keys []string
+	for key := range ms.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (ms *MemoryStateStore) GetField(ctx context.Context, key string, field string) (string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	value, ok := ms.hashes[key][field]
+	if !ok {
+		return "", ErrStateNotFound
+	}
+	return value, nil
+}
+
+func (ms *MemoryStateStore) SetField(ctx context.Context, key string, field string, value string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.hashes[key] == nil {
+		ms.hashes[key] = make(map[string]string)
+	}
+	ms.hashes[key][field] = value
+	return nil
+}
+
+func (ms *MemoryStateStore) DeleteField(ctx context.Context, key string, field string) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	_, ok := ms.hashes[key][field]
+	delete(ms.hashes[key], field)
+	return ok, nil
+}
+
+func (ms *MemoryStateStore) Fields(ctx context.Context, key string) (map[string]string, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	fields := make(map[string]string)
+	for field, value := range ms.hashes[key] {
+		fields[field] = value
+	}
+	return fields, nil
+}
+
+func (ms *MemoryStateStore) Lock(ctx context.Context, name string, ttl time.Duration) (func(), error) {
+	return ms.locks.acquire(name, ttl)
+}
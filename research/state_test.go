@@ -0,0 +1,125 @@
+package research
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testStateStore checks the behavior that all StateStores share.
+func testStateStore(t *testing.T, ss StateStore) {
+	ctx := context.Background()
+
+	if _, err := ss.Get(ctx, "missing"); err != ErrStateNotFound {
+		t.Errorf("Get of a missing key = %v, want ErrStateNotFound", err)
+	}
+	if err := ss.Set(ctx, "path-/a.pdf", "1"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if val, err := ss.Get(ctx, "path-/a.pdf"); err != nil || val != "1" {
+		t.Errorf("Get = %q, %v, want %q", val, err, "1")
+	}
+
+	err := ss.Apply(ctx, map[string]string{
+		"path-/[draft] b.pdf": "2",
+		"path-/c.pdf":         "3",
+		"other-/a.pdf":        "4",
+	}, []string{"path-/a.pdf"})
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if _, err := ss.Get(ctx, "path-/a.pdf"); err != ErrStateNotFound {
+		t.Errorf("Get of a key deleted by Apply = %v, want ErrStateNotFound", err)
+	}
+
+	if err := ss.SetField(ctx, "path-/hash", "field", "value"); err != nil {
+		t.Fatalf("SetField failed: %v", err)
+	}
+	keys, err := ss.Keys(ctx, "path-/")
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+	sort.Strings(keys)
+	if want := []string{"path-/[draft] b.pdf", "path-/c.pdf"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys = %q, want %q", keys, want)
+	}
+	if keys, err := ss.Keys(ctx, "path-/[draft]"); err != nil || len(keys) != 1 {
+		t.Errorf("Keys of a prefix with brackets = %q, %v, want one key", keys, err)
+	}
+
+	if val, err := ss.GetField(ctx, "path-/hash", "field"); err != nil || val != "value" {
+		t.Errorf("GetField = %q, %v, want %q", val, err, "value")
+	}
+	if _, err := ss.GetField(ctx, "path-/hash", "missing"); err != ErrStateNotFound {
+		t.Errorf("GetField of a missing field = %v, want ErrStateNotFound", err)
+	}
+	if err := ss.SetField(ctx, "path-/hash", "other", "value"); err != nil {
+		t.Fatalf("SetField failed: %v", err)
+	}
+	if ok, err := ss.DeleteField(ctx, "path-/hash", "other"); err != nil || !ok {
+		t.Errorf("DeleteField = %v, %v, want true", ok, err)
+	}
+	if ok, err := ss.DeleteField(ctx, "path-/hash", "other"); err != nil || ok {
+		t.Errorf("DeleteField of a deleted field = %v, %v, want false", ok, err)
+	}
+	fields, err := ss.Fields(ctx, "path-/hash")
+	if want := map[string]string{"field": "value"}; err != nil || !reflect.DeepEqual(fields, want) {
+		t.Errorf("Fields = %v, %v, want %v", fields, err, want)
+	}
+
+	if err := ss.Apply(ctx, nil, []string{"path-/hash"}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if fields, err := ss.Fields(ctx, "path-/hash"); err != nil || len(fields) != 0 {
+		t.Errorf("Fields of a hash deleted by Apply = %v, %v, want none", fields, err)
+	}
+	if err := ss.SetField(ctx, "path-/hash", "field", "value"); err != nil {
+		t.Fatalf("SetField failed: %v", err)
+	}
+	if err := ss.Delete(ctx, "path-/hash", "path-/c.pdf"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if fields, err := ss.Fields(ctx, "path-/hash"); err != nil || len(fields) != 0 {
+		t.Errorf("Fields of a deleted hash = %v, %v, want none", fields, err)
+	}
+	if _, err := ss.Get(ctx, "path-/c.pdf"); err != ErrStateNotFound {
+		t.Errorf("Get of a deleted key = %v, want ErrStateNotFound", err)
+	}
+
+	release, err := ss.Lock(ctx, "folder", time.Minute)
+	if err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if _, err := ss.Lock(ctx, "folder", time.Minute); err != ErrLocked {
+		t.Errorf("Lock of a held lock = %v, want ErrLocked", err)
+	}
+	release()
+	release, err = ss.Lock(ctx, "folder", time.Minute)
+	if err != nil {
+		t.Fatalf("Lock of a released lock failed: %v", err)
+	}
+	release()
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	testStateStore(t, NewMemoryStateStore())
+}
+
+func TestBoltStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notionify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bs, err := NewBoltStateStore(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStateStore failed: %v", err)
+	}
+	defer bs.Close()
+	testStateStore(t, bs)
+}
@@ -2,19 +2,24 @@ package research
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+	"github.com/shayanh/notionify/notionclient"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
 )
 
 // CloudFileSyncer synchronizes the given CloudFile within Notion.
 type CloudFileSyncer interface {
 	Sync(ctx context.Context, c *CloudFile) (*NotionPage, error)
+	// Delete handles the deletion of the file or folder stored at c.Path.
+	Delete(ctx context.Context, c *CloudFile) error
 }
 
 type DummyCloudFileSyncer struct{}
@@ -23,20 +28,65 @@ func (ds DummyCloudFileSyncer) Sync(ctx context.Context, c *CloudFile) (*NotionP
 	return &NotionPage{}, nil
 }
 
+func (ds DummyCloudFileSyncer) Delete(ctx context.Context, c *CloudFile) error {
+	return nil
+}
+
+// DeletePolicy determines what happens to the Notion page of a deleted file.
+type DeletePolicy string
+
+const (
+	// DeletePolicyNone leaves the Notion page untouched.
+	DeletePolicyNone DeletePolicy = ""
+	// DeletePolicyArchive archives the Notion page.
+	DeletePolicyArchive DeletePolicy = "archive"
+	// DeletePolicyTag adds TagDeleted to the Notion page.
+	DeletePolicyTag DeletePolicy = "tag"
+	// DeletePolicyClearURL removes the URL of the Notion page.
+	DeletePolicyClearURL DeletePolicy = "clear-url"
+)
+
+// SyncOptions configures how cloud files are synchronized with Notion.
+type SyncOptions struct {
+	DeletePolicy DeletePolicy
+	// UpdateTitles updates the title of a page when the title of its file
+	// changes, unless the title has been edited in Notion.
+	UpdateTitles bool
+	// DuplicatePolicy determines how new files with the content of a file
+	// that is already synchronized are handled.
+	DuplicatePolicy DuplicatePolicy
+}
+
+func (o SyncOptions) Validate() error {
+	switch o.DeletePolicy {
+	case DeletePolicyNone, DeletePolicyArchive, DeletePolicyTag, DeletePolicyClearURL:
+	default:
+		return errors.Errorf("unknown delete policy %q", o.DeletePolicy)
+	}
+	switch o.DuplicatePolicy {
+	case DuplicatePolicyNone, DuplicatePolicyLink, DuplicatePolicyAlternate, DuplicatePolicyTag:
+	default:
+		return errors.Errorf("unknown duplicate policy %q", o.DuplicatePolicy)
+	}
+	return nil
+}
+
 type CloudFileSyncerImpl struct {
-	nh  *NotionHandler
-	rdb *redis.Client
-	log *logrus.Logger
+	nh   *NotionHandler
+	ss   StateStore
+	log  *logrus.Logger
+	opts SyncOptions
 
 	lock   sync.Mutex
 	inProc map[string]bool
 }
 
-func NewCloudFileSyncerImpl(nh *NotionHandler, rdb *redis.Client, log *logrus.Logger) *CloudFileSyncerImpl {
+func NewCloudFileSyncerImpl(nh *NotionHandler, ss StateStore, log *logrus.Logger, opts SyncOptions) *CloudFileSyncerImpl {
 	return &CloudFileSyncerImpl{
 		nh:     nh,
-		rdb:    rdb,
+		ss:     ss,
 		log:    log,
+		opts:   opts,
 		inProc: make(map[string]bool),
 	}
 }
@@ -58,6 +108,7 @@ func (cs *CloudFileSyncerImpl) releaseProc(key string) {
 }
 
 var TagNeedsEdit = "needs edit"
+var TagDeleted = "deleted"
 
 func (cs *CloudFileSyncerImpl) Sync(ctx context.Context, c *CloudFile) (*NotionPage, error) {
 	key := c.GetKey()
@@ -66,8 +117,8 @@ func (cs *CloudFileSyncerImpl) Sync(ctx context.Context, c *CloudFile) (*NotionP
 	}
 	defer cs.releaseProc(key)
 
-	storedPageID, err := cs.rdb.Get(ctx, key).Result()
-	if err != redis.Nil && err != nil {
+	storedPageID, err := cs.ss.Get(ctx, key)
+	if err != ErrStateNotFound && err != nil {
 		return nil, errors.Wrap(err, "cloudfile Sync failed")
 	}
 	if err == nil {
@@ -77,10 +128,64 @@ func (cs *CloudFileSyncerImpl) Sync(ctx context.Context, c *CloudFile) (*NotionP
 			"PageID":    storedPageID,
 		}).Info("Notion page found.")
 
-		page, err := cs.nh.UpdatePage(ctx, c, storedPageID)
+		page, err := cs.update(ctx, c, storedPageID)
 		return page, errors.Wrap(err, "cloudfile Sync failed")
 	}
 
+	originalID, err := cs.getString(ctx, c.GetDuplicateKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "cloudfile Sync failed")
+	}
+	if originalID != "" {
+		lastHash, err := cs.getString(ctx, c.GetContentHashKey())
+		if err != nil {
+			return nil, errors.Wrap(err, "cloudfile Sync failed")
+		}
+		if lastHash == c.ContentHash {
+			page, err := cs.syncDuplicate(ctx, c, originalID)
+			if err != nil {
+				return nil, errors.Wrap(err, "cloudfile Sync failed")
+			}
+			return page, errors.Wrap(cs.savePath(ctx, c), "cloudfile Sync failed")
+		}
+		// The content has changed, so the file gets its own page.
+		if err := cs.unlinkDuplicate(ctx, c, originalID); err != nil {
+			return nil, errors.Wrap(err, "cloudfile Sync failed")
+		}
+	}
+
+	// The state may have been lost, while the page still names its file.
+	found, err := cs.nh.FindPageBySourceID(ctx, c.SourceID())
+	if err != nil {
+		return nil, errors.Wrap(err, "cloudfile Sync failed")
+	}
+	if found != nil {
+		cs.log.WithFields(logrus.Fields{
+			"FileID":    c.FileID,
+			"FileTitle": c.Title,
+			"PageID":    found.ID,
+		}).Info("Notion page found by source ID.")
+		if err := cs.ss.Set(ctx, key, found.ID); err != nil {
+			return nil, errors.Wrap(err, "cloudfile Sync failed")
+		}
+		page, err := cs.update(ctx, c, found.ID)
+		return page, errors.Wrap(err, "cloudfile Sync failed")
+	}
+
+	originalID, err = cs.findOriginal(ctx, c)
+	if err != nil {
+		return nil, errors.Wrap(err, "cloudfile Sync failed")
+	}
+	if originalID != "" {
+		switch cs.opts.DuplicatePolicy {
+		case DuplicatePolicyLink, DuplicatePolicyAlternate:
+			page, err := cs.linkDuplicate(ctx, c, originalID)
+			return page, errors.Wrap(err, "cloudfile Sync failed")
+		case DuplicatePolicyTag:
+			c.Tags = append(c.Tags, TagDuplicate)
+		}
+	}
+
 	c.Tags = append(c.Tags, TagNeedsEdit)
 	cs.log.Debugln(c.FileID, c.Title, c.Tags)
 	page, err := cs.nh.CreatePage(ctx, c)
@@ -88,76 +193,374 @@ func (cs *CloudFileSyncerImpl) Sync(ctx context.Context, c *CloudFile) (*NotionP
 		return nil, errors.Wrap(err, "cloudfile Sync failed")
 	}
 
-	err = cs.rdb.Set(ctx, key, page.ID, 0).Err()
+	err = cs.ss.Set(ctx, key, page.ID)
 	cs.log.WithFields(logrus.Fields{
 		"FileID":    c.FileID,
 		"FileTitle": c.Title,
 		"PageID":    page.ID,
 	}).Info("Notion page created.")
-	return page, err
+	if err != nil {
+		return page, err
+	}
+	if err := cs.ss.Set(ctx, c.GetLastTitleKey(), c.Title); err != nil {
+		return page, errors.Wrap(err, "cloudfile Sync failed")
+	}
+	if err := cs.saveFolderValues(ctx, c, cs.nh.FolderValues(c)); err != nil {
+		return page, errors.Wrap(err, "cloudfile Sync failed")
+	}
+	if err := cs.saveContentHash(ctx, c, page.ID); err != nil {
+		return page, errors.Wrap(err, "cloudfile Sync failed")
+	}
+	return page, errors.Wrap(cs.savePath(ctx, c), "cloudfile Sync failed")
+}
+
+// update updates the existing Notion page of c. The page title is only
+// overwritten if it still equals the last title we wrote to it.
+func (cs *CloudFileSyncerImpl) update(ctx context.Context, c *CloudFile, pageID string) (*NotionPage, error) {
+	lastPath, err := cs.getString(ctx, c.GetLastPathKey())
+	if err != nil {
+		return nil, err
+	}
+	lastTitle, err := cs.getString(ctx, c.GetLastTitleKey())
+	if err != nil {
+		return nil, err
+	}
+	if lastPath != "" && lastPath != c.Path {
+		cs.log.WithFields(logrus.Fields{
+			"FileID":  c.FileID,
+			"OldPath": lastPath,
+			"NewPath": c.Path,
+		}).Info("Cloud file moved.")
+	}
+
+	var extraProps []string
+	writeTitle := false
+	if cs.opts.UpdateTitles && lastTitle != "" && lastTitle != c.Title {
+		current, err := cs.nh.GetPage(ctx, pageID)
+		if err != nil {
+			return nil, err
+		}
+		if current.Name == lastTitle {
+			extraProps = append(extraProps, cs.nh.PropertyName(FieldName))
+			writeTitle = true
+		} else {
+			cs.log.WithFields(logrus.Fields{
+				"FileID":    c.FileID,
+				"FileTitle": c.Title,
+				"PageID":    pageID,
+				"PageName":  current.Name,
+			}).Info("Notion page title has been edited, keeping it.")
+		}
+	}
+
+	page, err := cs.nh.UpdatePage(ctx, c, pageID, extraProps...)
+	if err != nil {
+		return nil, err
+	}
+	if lastTitle == "" || writeTitle {
+		if err := cs.ss.Set(ctx, c.GetLastTitleKey(), c.Title); err != nil {
+			return page, err
+		}
+	}
+	if err := cs.updateFolderValues(ctx, c, pageID); err != nil {
+		return page, err
+	}
+	if err := cs.saveContentHash(ctx, c, pageID); err != nil {
+		return page, err
+	}
+	return page, cs.savePath(ctx, c)
+}
+
+// updateFolderValues updates the folder property of the page if the file has
+// been moved to folders that map to different values.
+func (cs *CloudFileSyncerImpl) updateFolderValues(ctx context.Context, c *CloudFile, pageID string) error {
+	if !cs.nh.props.Folders.Enabled() {
+		return nil
+	}
+	raw, err := cs.getString(ctx, c.GetLastFolderValuesKey())
+	if err != nil {
+		return err
+	}
+	var lastValues []string
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &lastValues); err != nil {
+			return err
+		}
+	}
+	values := cs.nh.FolderValues(c)
+	if raw != "" && equalStrings(lastValues, values) {
+		return nil
+	}
+	if _, err := cs.nh.SetFolderValues(ctx, pageID, lastValues, values); err != nil {
+		return err
+	}
+	cs.log.WithFields(logrus.Fields{
+		"FileID":    c.FileID,
+		"PageID":    pageID,
+		"OldValues": lastValues,
+		"NewValues": values,
+	}).Info("Notion page folder values updated.")
+	return cs.saveFolderValues(ctx, c, values)
+}
+
+func (cs *CloudFileSyncerImpl) saveFolderValues(ctx context.Context, c *CloudFile, values []string) error {
+	if !cs.nh.props.Folders.Enabled() {
+		return nil
+	}
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return cs.ss.Set(ctx, c.GetLastFolderValuesKey(), string(raw))
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// getString returns the value of key, or an empty string if it does not
+// exist.
+func (cs *CloudFileSyncerImpl) getString(ctx context.Context, key string) (string, error) {
+	val, err := cs.ss.Get(ctx, key)
+	if err == ErrStateNotFound {
+		return "", nil
+	}
+	return val, err
+}
+
+// savePath records c.Path in the path to ID index.
+func (cs *CloudFileSyncerImpl) savePath(ctx context.Context, c *CloudFile) error {
+	if c.Path == "" {
+		return nil
+	}
+	lastPath, err := cs.getString(ctx, c.GetLastPathKey())
+	if err != nil {
+		return err
+	}
+	var del []string
+	if lastPath != "" && !strings.EqualFold(lastPath, c.Path) {
+		del = append(del, CloudFile{Provider: c.Provider, Namespace: c.Namespace, Path: lastPath}.GetPathKey())
+	}
+	return cs.ss.Apply(ctx, map[string]string{
+		c.GetPathKey():     c.FileID,
+		c.GetLastPathKey(): c.Path,
+	}, del)
+}
+
+// Delete handles the deletion of the file or folder at c.Path. The state of
+// the deleted files is removed whatever the delete policy is.
+func (cs *CloudFileSyncerImpl) Delete(ctx context.Context, c *CloudFile) error {
+	fileID, err := cs.ss.Get(ctx, c.GetPathKey())
+	switch err {
+	case ErrStateNotFound:
+		// Deleted folders are reported without the files in them.
+		err = cs.deleteFolder(ctx, c)
+	case nil:
+		c.FileID = fileID
+		err = cs.deleteFile(ctx, c)
+	}
+	return errors.Wrap(err, "cloudfile Delete failed")
+}
+
+// deleteFolder deletes the indexed files below the folder at c.Path.
+func (cs *CloudFileSyncerImpl) deleteFolder(ctx context.Context, c *CloudFile) error {
+	keys, err := cs.ss.Keys(ctx, c.GetPathKey()+"/")
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		cs.log.WithField("Path", c.Path).Info("Deleted file is not indexed.")
+		return nil
+	}
+	// The keys contain the lower case paths of the files.
+	keyPrefix := strings.TrimSuffix(c.GetPathKey(), strings.ToLower(c.Path))
+	var errs error
+	for _, key := range keys {
+		fileID, err := cs.ss.Get(ctx, key)
+		if err == ErrStateNotFound {
+			continue
+		}
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		file := &CloudFile{
+			Provider:  c.Provider,
+			Namespace: c.Namespace,
+			FileID:    fileID,
+			Path:      strings.TrimPrefix(key, keyPrefix),
+		}
+		errs = multierr.Append(errs, cs.deleteFile(ctx, file))
+	}
+	return errs
+}
+
+// deleteFile applies the delete policy to the page of the deleted file c and
+// removes its state.
+func (cs *CloudFileSyncerImpl) deleteFile(ctx context.Context, c *CloudFile) error {
+	key := c.GetKey()
+	if err := cs.acquireProc(key); err != nil {
+		return err
+	}
+	defer cs.releaseProc(key)
+
+	lastPath, err := cs.getString(ctx, c.GetLastPathKey())
+	if err != nil {
+		return err
+	}
+	if lastPath != "" && !strings.EqualFold(lastPath, c.Path) {
+		// The file has been moved, only the stale index entry is removed.
+		return cs.ss.Delete(ctx, c.GetPathKey())
+	}
+
+	originalID, err := cs.getString(ctx, c.GetDuplicateKey())
+	if err != nil {
+		return err
+	}
+	if originalID != "" {
+		return cs.deleteDuplicate(ctx, c, originalID)
+	}
+
+	pageID, err := cs.ss.Get(ctx, key)
+	if err != ErrStateNotFound && err != nil {
+		return err
+	}
+	if err == nil && cs.opts.DeletePolicy != DeletePolicyNone {
+		switch cs.opts.DeletePolicy {
+		case DeletePolicyArchive:
+			err = cs.nh.ArchivePage(ctx, pageID)
+		case DeletePolicyTag:
+			_, err = cs.nh.AddTags(ctx, pageID, TagDeleted)
+		case DeletePolicyClearURL:
+			_, err = cs.nh.ClearURL(ctx, pageID)
+		default:
+			err = errors.Errorf("unknown delete policy %q", cs.opts.DeletePolicy)
+		}
+		if err != nil {
+			return err
+		}
+		cs.log.WithFields(logrus.Fields{
+			"FileID": c.FileID,
+			"Path":   c.Path,
+			"PageID": pageID,
+			"Policy": cs.opts.DeletePolicy,
+		}).Info("Notion page of deleted file handled.")
+	}
+
+	if pageID != "" {
+		lastHash, err := cs.getString(ctx, c.GetContentHashKey())
+		if err != nil {
+			return err
+		}
+		if err := cs.unindexContentHash(ctx, c.keySpace(), lastHash, pageID); err != nil {
+			return err
+		}
+		if err := cs.unlinkDuplicates(ctx, c, pageID); err != nil {
+			return err
+		}
+	}
+
+	return cs.ss.Delete(ctx, key, c.GetPathKey(), c.GetLastPathKey(), c.GetLastTitleKey(), c.GetLastFolderValuesKey(), c.GetContentHashKey())
 }
 
 type NotionSyncer interface {
 	SyncDatabase(ctx context.Context) ([]*CloudFile, error)
 }
 
+// NotionSyncerImpl archives the files that pages of the database link to,
+// e.g. the PDFs of papers, to a folder of a storage provider. The URL of an
+// archived page is replaced with the link of its file.
 type NotionSyncerImpl struct {
 	cloudFolderPath string
+	rules           ArchiveRules
 	nh              *NotionHandler
 	cu              CloudUploader
-	rdb             *redis.Client
+	ss              StateStore
 	log             *logrus.Logger
 	client          *http.Client
+	lock            sync.Mutex
 }
 
-func NewNotionSyncerImpl(path string, nh *NotionHandler, cu CloudUploader, rdb *redis.Client, log *logrus.Logger) *NotionSyncerImpl {
+// NewNotionSyncerImpl returns a syncer that archives the pages of nh that
+// match rules to the folder path of cu.
+func NewNotionSyncerImpl(path string, rules ArchiveRules, nh *NotionHandler, cu CloudUploader, ss StateStore, log *logrus.Logger) *NotionSyncerImpl {
 	return &NotionSyncerImpl{
 		cloudFolderPath: path,
+		rules:           rules,
 		nh:              nh,
 		cu:              cu,
-		rdb:             rdb,
+		ss:              ss,
 		log:             log,
-		client:          &http.Client{},
+		client: &http.Client{
+			Timeout: 5 * time.Minute,
+		},
 	}
 }
 
+// SyncDatabase archives the matching pages. Pages that fail are reported in
+// the error and are retried on the next run.
 func (ns *NotionSyncerImpl) SyncDatabase(ctx context.Context) ([]*CloudFile, error) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
 	pages, err := ns.nh.ListPages(ctx)
-	if err != nil {
-		return nil, err
+	if notionclient.IsMalformed(err) {
+		ns.log.Warn(err)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "SyncDatabase failed")
 	}
+	var errs error
 	var cloudFiles []*CloudFile
 	for _, page := range pages {
 		ns.log.Debugln(page.Name, page.Type, page.URL)
 
 		c, err := ns.syncPage(ctx, page)
 		if err != nil {
-			return nil, err
+			errs = multierr.Append(errs, errors.Wrapf(err, "archiving page %s failed", page.ID))
+			continue
 		}
 		if c != nil {
 			cloudFiles = append(cloudFiles, c)
 		}
 	}
-	return cloudFiles, nil
+	return cloudFiles, errs
 }
 
-func (ns *NotionSyncerImpl) shouldSync(page *NotionPage) bool {
-	if page.Type != "paper" {
-		return false
+// shouldSync reports whether the page is archived. Pages whose URL did not
+// point to a PDF are skipped until their URL changes.
+func (ns *NotionSyncerImpl) shouldSync(ctx context.Context, page *NotionPage) (bool, error) {
+	if !ns.rules.Match(page) {
+		return false, nil
 	}
-	// TODO
-	if strings.HasPrefix(page.URL, "https://www.dropbox.com/") {
-		return false
+	skipped, err := ns.ss.Get(ctx, getArchiveSkippedKey(page.ID))
+	if err == ErrStateNotFound {
+		return true, nil
 	}
-	return true
+	if err != nil {
+		return false, err
+	}
+	return skipped != page.URL, nil
 }
 
 func (ns *NotionSyncerImpl) syncPage(ctx context.Context, page *NotionPage) (*CloudFile, error) {
-	if !ns.shouldSync(page) {
-		return nil, nil
+	ok, err := ns.shouldSync(ctx, page)
+	if err != nil || !ok {
+		return nil, err
 	}
 
-	resp, err := ns.client.Get(page.URL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL(page.URL), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ns.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -166,25 +569,44 @@ func (ns *NotionSyncerImpl) syncPage(ctx context.Context, page *NotionPage) (*Cl
 			ns.log.Errorf("Error while closing response body: %v", err)
 		}
 	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("download of %s failed with status %d", resp.Request.URL, resp.StatusCode)
+	}
+	if !isPDF(resp) {
+		ns.log.WithFields(logrus.Fields{
+			"PageID":      page.ID,
+			"PageName":    page.Name,
+			"URL":         resp.Request.URL.String(),
+			"ContentType": resp.Header.Get("Content-Type"),
+		}).Warn("Page does not link to a PDF, skipping it.")
+		return nil, ns.ss.Set(ctx, getArchiveSkippedKey(page.ID), page.URL)
+	}
 
-	cloudFilePath := path.Join(ns.cloudFolderPath, path.Base(page.URL))
+	cloudFilePath := path.Join(ns.cloudFolderPath, archiveFileName(page, resp.Request.URL))
 	cloudFile, err := ns.cu.Upload(cloudFilePath, resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	_, err = ns.nh.UpdatePage(ctx, cloudFile, page.ID)
+	// The file is mapped to the page before the page is updated, so that the
+	// synchronization of the new file does not create another page.
+	err = ns.ss.Set(ctx, cloudFile.GetKey(), page.ID)
 	if err != nil {
 		return nil, err
 	}
-	err = ns.rdb.Set(ctx, cloudFile.GetKey(), page.ID, 0).Err()
+	_, err = ns.nh.UpdatePage(ctx, cloudFile, page.ID)
 	if err != nil {
 		return nil, err
 	}
+	if err := ns.ss.Delete(ctx, getArchiveSkippedKey(page.ID)); err != nil {
+		return nil, err
+	}
 	ns.log.WithFields(logrus.Fields{
 		"PageID":    page.ID,
 		"PageName":  page.Name,
 		"FileID":    cloudFile.FileID,
 		"FileTitle": cloudFile.Title,
+		"OldURL":    page.URL,
+		"NewURL":    cloudFile.URL,
 	}).Info("Cloud file created.")
 	return cloudFile, nil
 }
@@ -0,0 +1,364 @@
+package research
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+// FolderSynchronizer ensures that all files inside a folder of a
+// StorageProvider are synchronized with Notion.
+type FolderSynchronizer struct {
+	recursive bool
+	workers   int
+	cb        *CloudFileBuilder
+	cs        CloudFileSyncer
+	ss        StateStore
+	log       *logrus.Logger
+	lock      sync.Mutex
+}
+
+// NewFolderSynchronizer returns a synchronizer for the provider of cb. Its
+// state is separated from other accounts of the provider by the namespace of
+// cb. If recursive is set, files in subfolders are synchronized too. Up to
+// workers entries are synchronized with Notion concurrently.
+func NewFolderSynchronizer(recursive bool, workers int, cb *CloudFileBuilder, cs CloudFileSyncer, ss StateStore, log *logrus.Logger) *FolderSynchronizer {
+	if workers <= 0 {
+		workers = defaultSyncWorkers
+	}
+	return &FolderSynchronizer{
+		recursive: recursive,
+		workers:   workers,
+		cb:        cb,
+		cs:        cs,
+		ss:        ss,
+		log:       log,
+	}
+}
+
+func (fs *FolderSynchronizer) SyncFolder(ctx context.Context, path string) ([]*NotionPage, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	// Other processes that share the state may synchronize the same folder.
+	key := fs.getCursorKey(path)
+	release, err := fs.ss.Lock(ctx, key, syncLockTTL)
+	if err != nil {
+		return nil, errors.Wrap(err, "SyncFolder failed")
+	}
+	defer release()
+
+	if err := fs.migrateKeys(ctx, path); err != nil {
+		return nil, errors.Wrap(err, "SyncFolder failed")
+	}
+
+	sp := fs.cb.Provider()
+	var cursor string
+	if val, err := fs.ss.Get(ctx, key); err != ErrStateNotFound {
+		if err != nil {
+			return nil, errors.Wrap(err, "SyncFolder failed")
+		}
+		cursor = val
+		fs.log.WithFields(logrus.Fields{
+			"provider": sp.Name(),
+			"path":     path,
+			"cursor":   shortCursor(cursor),
+		}).Info("Cursor has been retrieved.")
+	}
+
+	entries, newCursor, err := sp.List(ctx, path, cursor, fs.recursive)
+	if err != nil {
+		if err := fs.ss.Delete(ctx, key); err != nil {
+			fs.log.WithError(err).Error("cannot delete cursor")
+		} else {
+			fs.log.WithFields(logrus.Fields{
+				"provider": sp.Name(),
+				"path":     path,
+				"cursor":   shortCursor(cursor),
+			}).Info("Cursor has been deleted.")
+		}
+		return nil, errors.Wrap(err, "SyncFolder failed")
+	}
+
+	var errs error
+	var pages []*NotionPage
+	var files, deleted []*StorageEntry
+	existing := make(map[string]bool)
+	haveErr := false
+	for _, entry := range entries {
+		switch entry.Kind {
+		case EntryFile:
+			fs.log.WithFields(logrus.Fields{
+				"Provider": sp.Name(),
+				"Path":     entry.Path,
+				"ID":       entry.ID,
+			}).Info("Cloud file")
+			existing[strings.ToLower(entry.Path)] = true
+			files = append(files, entry)
+		case EntryFolder:
+			fs.log.WithFields(logrus.Fields{
+				"Provider": sp.Name(),
+				"Path":     entry.Path,
+				"ID":       entry.ID,
+			}).Info("Cloud folder")
+		case EntryDeleted:
+			fs.log.WithFields(logrus.Fields{
+				"Provider": sp.Name(),
+				"Path":     entry.Path,
+			}).Info("Cloud deleted")
+			deleted = append(deleted, entry)
+		}
+	}
+
+	// Entries that keep failing are dead-lettered, so that they do not hold
+	// back the cursor. Transient errors hold back the cursor instead, so the
+	// entries are listed again by the next synchronization.
+	handle := func(entry *StorageEntry, err error) {
+		if !isTransient(err) && fs.deadLetter(ctx, path, entry, err) {
+			err = deadLetteredError{err}
+		} else {
+			haveErr = true
+		}
+		errs = multierr.Append(errs, err)
+	}
+
+	cloudFiles, buildErrs := fs.cb.BuildAll(ctx, files)
+	filePages := make([]*NotionPage, len(files))
+	fileErrs := make([]error, len(files))
+	// Files with the same content are synchronized one after another, so
+	// that the later ones find the page of the first in the content hash
+	// index instead of creating their own.
+	groups := groupByContentHash(files)
+	fs.forEach(len(groups), func(g int) {
+		for _, i := range groups[g] {
+			filePages[i], fileErrs[i] = fs.syncFile(ctx, path, files[i], cloudFiles[i], buildErrs[i])
+		}
+	})
+	for i, entry := range files {
+		if fileErrs[i] != nil {
+			handle(entry, fileErrs[i])
+			continue
+		}
+		pages = append(pages, filePages[i])
+	}
+
+	// Deletions are handled after all files so that a file moved within
+	// this batch is not mistaken for a deleted one.
+	var deletions []*StorageEntry
+	for _, entry := range deleted {
+		if !existing[strings.ToLower(entry.Path)] {
+			deletions = append(deletions, entry)
+		}
+	}
+	deleteErrs := make([]error, len(deletions))
+	fs.forEach(len(deletions), func(i int) {
+		deleteErrs[i] = fs.deleteFile(ctx, deletions[i])
+	})
+	for i, entry := range deletions {
+		if deleteErrs[i] != nil {
+			handle(entry, deleteErrs[i])
+		}
+	}
+
+	listed := make(map[string]bool)
+	for _, entry := range entries {
+		listed[strings.ToLower(entry.Path)] = true
+	}
+	pages = append(pages, fs.retryDeadLetters(ctx, path, listed)...)
+
+	stats := fs.cb.ExtractionStats()
+	fs.log.WithFields(logrus.Fields{
+		"Provider":  sp.Name(),
+		"Downloads": stats.Downloads,
+		"Skipped":   stats.Skipped,
+		"Bytes":     stats.Bytes,
+		"Duration":  stats.Duration,
+	}).Info("Extraction downloads so far.")
+
+	if !haveErr && newCursor != cursor {
+		err := fs.ss.Set(ctx, key, newCursor)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			return pages, errs
+		}
+		fs.log.WithFields(logrus.Fields{
+			"provider": sp.Name(),
+			"path":     path,
+			"cursor":   shortCursor(newCursor),
+		}).Info("New cursor saved.")
+	}
+	return pages, errs
+}
+
+// syncLockTTL is how long a folder stays locked after its synchronization
+// stopped renewing the lock, e.g. because the process crashed.
+const syncLockTTL = 2 * time.Minute
+
+// defaultSyncWorkers is the number of entries synchronized concurrently when
+// no number is given. Notion allows about three requests per second.
+const defaultSyncWorkers = 3
+
+// forEach calls fn for 0 <= i < n on up to fs.workers goroutines and waits
+// for all calls to return.
+func (fs *FolderSynchronizer) forEach(n int, fn func(i int)) {
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < fs.workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
+
+// groupByContentHash returns the indices of entries grouped by their content
+// hash. Entries without a hash are in groups of their own.
+func groupByContentHash(entries []*StorageEntry) [][]int {
+	var groups [][]int
+	byHash := make(map[string]int)
+	for i, entry := range entries {
+		if entry.ContentHash == "" {
+			groups = append(groups, []int{i})
+			continue
+		}
+		g, ok := byHash[entry.ContentHash]
+		if !ok {
+			g = len(groups)
+			byHash[entry.ContentHash] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+const (
+	// syncAttempts is how often an entry is tried before it is
+	// dead-lettered.
+	syncAttempts = 3
+	// retryBackoff is the delay before the first retry. It doubles with
+	// every retry.
+	retryBackoff = time.Second
+)
+
+// retry calls fn until it succeeds, at most syncAttempts times.
+func (fs *FolderSynchronizer) retry(ctx context.Context, fn func(attempt int) error) error {
+	backoff := retryBackoff
+	var err error
+	for attempt := 0; attempt < syncAttempts; attempt++ {
+		if attempt > 0 {
+			fs.log.WithError(err).WithField("Attempt", attempt+1).Warn("Retrying entry")
+			select {
+			case <-ctx.Done():
+				return multierr.Append(err, ctx.Err())
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if err = fn(attempt); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// syncFile syncs the file of entry with Notion. cloudFile and buildErr are
+// the result of building it, which is repeated on retries.
+func (fs *FolderSynchronizer) syncFile(ctx context.Context, root string, entry *StorageEntry, cloudFile *CloudFile, buildErr error) (*NotionPage, error) {
+	var page *NotionPage
+	err := fs.retry(ctx, func(attempt int) error {
+		c, err := cloudFile, buildErr
+		if attempt > 0 {
+			c, err = fs.cb.Build(ctx, entry)
+		}
+		if err != nil {
+			return err
+		}
+		c.Folders = FolderSegments(root, entry.Path)
+		page, err = fs.cs.Sync(ctx, c)
+		if err != nil {
+			fs.log.WithField("CloudFile", c).Error(err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs.removeDeadLetter(ctx, entry.Path)
+	return page, nil
+}
+
+func (fs *FolderSynchronizer) deleteFile(ctx context.Context, entry *StorageEntry) error {
+	cloudFile := &CloudFile{
+		Path:      entry.Path,
+		Provider:  fs.cb.Provider().Name(),
+		Namespace: fs.cb.Namespace(),
+	}
+	err := fs.retry(ctx, func(int) error {
+		err := fs.cs.Delete(ctx, cloudFile)
+		if err != nil {
+			fs.log.WithField("CloudFile", cloudFile).Error(err)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fs.removeDeadLetter(ctx, entry.Path)
+	return nil
+}
+
+func (fs *FolderSynchronizer) getCursorKey(path string) string {
+	key := "cursor-" + fs.cb.Provider().Name() + "-"
+	if ns := fs.cb.Namespace(); ns != "" {
+		key += ns + "-"
+	}
+	key += path
+	// A cursor keeps the recursiveness of the listing it was created by.
+	if fs.recursive {
+		key += "-recursive"
+	}
+	return key
+}
+
+// pollInterval is how often a folder is polled when no interval is
+// configured.
+const pollInterval = 5 * time.Minute
+
+// PollFolder synchronizes path every interval until ctx is done. It is used
+// for providers that cannot notify about changes.
+func PollFolder(ctx context.Context, fs *FolderSynchronizer, path string, interval time.Duration) {
+	if interval <= 0 {
+		interval = pollInterval
+	}
+	for {
+		pages, err := fs.SyncFolder(ctx, path)
+		if err != nil {
+			fs.log.Error(err)
+		}
+		for _, page := range pages {
+			fs.log.WithFields(logrus.Fields{
+				"Name": page.Name,
+				"ID":   page.ID,
+			}).Info("Synced page")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
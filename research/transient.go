@@ -0,0 +1,66 @@
+package research
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox/auth"
+	"github.com/jomei/notionapi"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+// statusError is an unexpected response status of an HTTP API.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func newStatusError(status int, format string, args ...interface{}) error {
+	return errors.WithStack(&statusError{
+		status: status,
+		msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+func transientStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// isTransient reports whether err, or one of the errors combined in it, is
+// likely to go away when the request is repeated later: network errors, rate
+// limits and server errors.
+func isTransient(err error) bool {
+	for _, err := range multierr.Errors(err) {
+		var notionErr *notionapi.Error
+		var statusErr *statusError
+		var sdkErr dropbox.SDKInternalError
+		var netErr net.Error
+		switch {
+		case errors.As(err, &notionErr):
+			if transientStatus(notionErr.Status) || notionErr.Status == http.StatusConflict {
+				return true
+			}
+		case errors.As(err, &statusErr):
+			if transientStatus(statusErr.status) {
+				return true
+			}
+		case errors.As(err, &sdkErr):
+			if transientStatus(sdkErr.StatusCode) {
+				return true
+			}
+		case errors.As(err, new(auth.RateLimitAPIError)), errors.As(err, new(auth.ServerError)):
+			return true
+		case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF):
+			return true
+		}
+	}
+	return false
+}
@@ -1,25 +1,67 @@
 package research
 
 import (
-	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	dropboxSignatureHeader = "X-Dropbox-Signature"
+	// maxWebhookBody is the size in bytes above which webhook bodies are
+	// rejected before they are authenticated.
+	maxWebhookBody = 1 << 20
+)
+
+// DropboxAccount is a Dropbox account whose root folder is synchronized with
+// its own Notion database.
+type DropboxAccount struct {
+	ID       string
+	RootPath string
+	fs       *FolderSynchronizer
+}
+
+func NewDropboxAccount(id string, rootPath string, fs *FolderSynchronizer) *DropboxAccount {
+	return &DropboxAccount{
+		ID:       id,
+		RootPath: rootPath,
+		fs:       fs,
+	}
+}
+
+// dropboxNotification is the body of a Dropbox webhook notification.
+type dropboxNotification struct {
+	ListFolder struct {
+		Accounts []string `json:"accounts"`
+	} `json:"list_folder"`
+}
+
+// DropboxWebhookHandler enqueues a synchronization of the accounts that a
+// Dropbox webhook notification is about.
 type DropboxWebhookHandler struct {
-	rootPath string
-	ds       *DropboxSynchronizer
-	log      *logrus.Logger
+	appSecret []byte
+	accounts  map[string]*DropboxAccount
+	sq        *SyncQueue
+	log       *logrus.Logger
 }
 
-func NewDropboxWebhookHandler(path string, ds *DropboxSynchronizer, log *logrus.Logger) *DropboxWebhookHandler {
-	return &DropboxWebhookHandler{
-		rootPath: path,
-		ds:       ds,
-		log:      log,
+func NewDropboxWebhookHandler(appSecret string, accounts []*DropboxAccount, sq *SyncQueue, log *logrus.Logger) *DropboxWebhookHandler {
+	dwh := &DropboxWebhookHandler{
+		appSecret: []byte(appSecret),
+		accounts:  make(map[string]*DropboxAccount),
+		sq:        sq,
+		log:       log,
+	}
+	for _, account := range accounts {
+		dwh.accounts[account.ID] = account
 	}
+	return dwh
 }
 
 func (dwh *DropboxWebhookHandler) handleChallenge(w http.ResponseWriter, r *http.Request) {
@@ -32,28 +74,79 @@ func (dwh *DropboxWebhookHandler) handleChallenge(w http.ResponseWriter, r *http
 	}
 }
 
+// verifySignature checks that signature is the hex encoded HMAC-SHA256 of
+// body keyed by the Dropbox app secret.
+func (dwh *DropboxWebhookHandler) verifySignature(body []byte, signature string) bool {
+	if len(dwh.appSecret) == 0 || signature == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, dwh.appSecret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// bearerAuthorized reports whether r carries token as bearer token. No
+// request is authorized when token is empty.
+func bearerAuthorized(r *http.Request, token string) bool {
+	expected := "Bearer " + token
+	return token != "" && hmac.Equal([]byte(r.Header.Get("Authorization")), []byte(expected))
+}
+
+// affectedAccounts returns the accounts that have to be synchronized for the
+// given notification. An account configured without an ID is affected by
+// every notification.
+func (dwh *DropboxWebhookHandler) affectedAccounts(notification *dropboxNotification) []*DropboxAccount {
+	var accounts []*DropboxAccount
+	if account, ok := dwh.accounts[""]; ok {
+		accounts = append(accounts, account)
+	}
+	seen := make(map[string]bool)
+	for _, accountID := range notification.ListFolder.Accounts {
+		if accountID == "" || seen[accountID] {
+			continue
+		}
+		seen[accountID] = true
+		account, ok := dwh.accounts[accountID]
+		if !ok {
+			dwh.log.WithField("AccountID", accountID).Warn("Notification for unknown Dropbox account")
+			continue
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
 func (dwh *DropboxWebhookHandler) handleWebhook(w http.ResponseWriter, r *http.Request) {
-	// TODO: authentication
-	// Assuming that we have only one user
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				dwh.log.Errorf("Recovered from panic: %s", r)
-			}
-		}()
-
-		pages, err := dwh.ds.SyncFolder(context.Background(), dwh.rootPath)
-		if err != nil {
-			dwh.log.Error(err)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		dwh.log.Errorf("Error while reading webhook body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !dwh.verifySignature(body, r.Header.Get(dropboxSignatureHeader)) {
+		dwh.log.Warn("Dropbox webhook signature verification failed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var notification dropboxNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		dwh.log.Errorf("Error while decoding webhook body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, account := range dwh.affectedAccounts(&notification) {
+		if err := dwh.sq.Enqueue(r.Context(), account.fs, account.RootPath); err != nil {
+			dwh.log.WithField("AccountID", account.ID).Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		for _, page := range pages {
-			dwh.log.WithFields(logrus.Fields{
-				"Name": page.Name,
-				"ID":   page.ID,
-			}).Info("Synced page")
-		}
-	}()
+	}
 }
 
 func (dwh *DropboxWebhookHandler) HandleFuncs(router *mux.Router) {
@@ -0,0 +1,94 @@
+package research
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLogger() *logrus.Logger {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return log
+}
+
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestDropboxWebhook(t *testing.T) {
+	const secret = "app-secret"
+	const body = `{"list_folder": {"accounts": ["dbid:1"]}}`
+
+	tests := []struct {
+		name      string
+		body      string
+		signature string
+		status    int
+		enqueued  bool
+	}{
+		{"valid signature", body, sign(secret, body), http.StatusOK, true},
+		{"missing signature", body, "", http.StatusForbidden, false},
+		{"signature of other body", body, sign(secret, `{}`), http.StatusForbidden, false},
+		{"signature with other secret", body, sign("other", body), http.StatusForbidden, false},
+		{"malformed signature", body, "not hex", http.StatusForbidden, false},
+		{"body too large", strings.Repeat(" ", maxWebhookBody+1), "", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := newTestLogger()
+			dh := NewDropboxHandler("token", DropboxLinkOptions{}, log)
+			cb := NewCloudFileBuilder(dh, "dbid:1", nil, 0, 1, log)
+			fs := NewFolderSynchronizer(false, 1, cb, DummyCloudFileSyncer{}, NewMemoryStateStore(), log)
+			sq := NewSyncQueue(nil, 1, 0, log)
+			accounts := []*DropboxAccount{NewDropboxAccount("dbid:1", "/papers", fs)}
+			router := mux.NewRouter()
+			NewDropboxWebhookHandler(secret, accounts, sq, log).HandleFuncs(router.PathPrefix("/dropbox-webhook").Subrouter())
+
+			req := httptest.NewRequest(http.MethodPost, "/dropbox-webhook", strings.NewReader(tt.body))
+			if tt.signature != "" {
+				req.Header.Set(dropboxSignatureHeader, tt.signature)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			jobs := sq.local.jobs
+			if !tt.enqueued {
+				if len(jobs) != 0 {
+					t.Errorf("enqueued %v, want no job", jobs)
+				}
+				return
+			}
+			if len(jobs) != 1 || jobs[0].name != fs.Name() || jobs[0].path != "/papers" {
+				t.Errorf("enqueued %v, want a job for %s /papers", jobs, fs.Name())
+			}
+		})
+	}
+}
+
+func TestDropboxWebhookChallenge(t *testing.T) {
+	log := newTestLogger()
+	router := mux.NewRouter()
+	NewDropboxWebhookHandler("secret", nil, NewSyncQueue(nil, 1, 0, log), log).HandleFuncs(router.PathPrefix("/dropbox-webhook").Subrouter())
+
+	req := httptest.NewRequest(http.MethodGet, "/dropbox-webhook?challenge=abc", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "abc" {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), "abc")
+	}
+}
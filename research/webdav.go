@@ -0,0 +1,404 @@
+package research
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+const webDAVProvider = "webdav"
+
+// WebDAVOptions configures a WebDAVProvider.
+type WebDAVOptions struct {
+	// URL is the WebDAV root, e.g.
+	// https://cloud.example.com/remote.php/dav/files/alice for Nextcloud.
+	URL      string
+	Username string
+	Password string
+	// ShareURL is the base URL of a Nextcloud or ownCloud server whose OCS
+	// share API creates the share links of files. The WebDAV URL of a file is
+	// used as its link when it is empty.
+	ShareURL string
+}
+
+// WebDAVProvider is a StorageProvider for a WebDAV server such as Nextcloud.
+// Changes are detected by comparing the ETags returned by PROPFIND with a
+// snapshot of the previous listing, which is stored as cursor. Folders whose
+// ETag has not changed are not listed again.
+type WebDAVProvider struct {
+	opts   WebDAVOptions
+	base   *url.URL
+	client *http.Client
+}
+
+func NewWebDAVProvider(opts WebDAVOptions) (*WebDAVProvider, error) {
+	base, err := url.Parse(strings.TrimSuffix(opts.URL, "/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid webdav URL")
+	}
+	return &WebDAVProvider{
+		opts:   opts,
+		base:   base,
+		client: &http.Client{},
+	}, nil
+}
+
+func (wp *WebDAVProvider) Name() string {
+	return webDAVProvider
+}
+
+func (wp *WebDAVProvider) fileURL(p string) string {
+	u := *wp.base
+	u.Path += path.Clean("/" + p)
+	return u.String()
+}
+
+// relPath converts the href of a PROPFIND response to a provider path.
+func (wp *WebDAVProvider) relPath(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	p := strings.TrimPrefix(u.Path, wp.base.Path)
+	return path.Clean("/" + p), nil
+}
+
+// webDAVFileID derives an ID for servers that do not report oc:fileid.
+// Moved files keep their original ID through the snapshot.
+func webDAVFileID(entry *StorageEntry) string {
+	sum := sha1.Sum([]byte(entry.Path))
+	return hex.EncodeToString(sum[:10])
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getetag/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+    <oc:fileid/>
+  </d:prop>
+</d:propfind>`
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ETag          string `xml:"DAV: getetag"`
+				ContentLength int64  `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				FileID        string `xml:"http://owncloud.org/ns fileid"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind returns the entries of p and, for depth 1, of its children.
+func (wp *WebDAVProvider) propfind(ctx context.Context, p string, depth int) ([]*StorageEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", wp.fileURL(p), strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", fmt.Sprint(depth))
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := wp.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+	var entries []*StorageEntry
+	for _, r := range ms.Responses {
+		entryPath, err := wp.relPath(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		entry := &StorageEntry{Kind: EntryFile, Path: entryPath}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				entry.Kind = EntryFolder
+			}
+			entry.Rev = strings.Trim(strings.TrimPrefix(ps.Prop.ETag, "W/"), `"`)
+			entry.Size = ps.Prop.ContentLength
+			entry.Modified, _ = http.ParseTime(ps.Prop.LastModified)
+			if ps.Prop.FileID != "" {
+				entry.ID = ps.Prop.FileID
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (wp *WebDAVProvider) List(ctx context.Context, p string, cursor string, recursive bool) ([]*StorageEntry, string, error) {
+	prev, err := decodeSnapshot(cursor)
+	if err != nil {
+		return nil, cursor, errors.Wrap(err, "webdav List failed")
+	}
+
+	// Servers often refuse Depth: infinity, so folders are walked one level
+	// at a time. The ETag of a folder changes with its content, so the files
+	// of folders with the ETag of the snapshot are taken from the snapshot.
+	var listing []*StorageEntry
+	folderRevs := make(map[string]string)
+	folders := []string{path.Clean("/" + p)}
+	for len(folders) > 0 {
+		folder := folders[0]
+		folders = folders[1:]
+		entries, err := wp.propfind(ctx, folder, 1)
+		if err != nil {
+			return nil, cursor, errors.Wrap(err, "webdav List failed")
+		}
+		for _, entry := range entries {
+			if entry.Path == folder || isHidden(path.Base(entry.Path)) {
+				continue
+			}
+			if entry.Kind == EntryFolder {
+				if !recursive {
+					continue
+				}
+				if old, ok := prev[entry.Path]; ok && old.Folder && old.Rev != "" && old.Rev == entry.Rev {
+					listing = append(listing, prev.below(entry.Path, folderRevs)...)
+				} else {
+					folders = append(folders, entry.Path)
+				}
+				folderRevs[entry.Path] = entry.Rev
+				continue
+			}
+			listing = append(listing, entry)
+		}
+	}
+
+	entries, cur := diffListing(prev, listing, webDAVFileID)
+	for folder, rev := range folderRevs {
+		cur[folder] = snapshotEntry{Rev: rev, Folder: true}
+	}
+	newCursor, err := cur.encode()
+	if err != nil {
+		return nil, cursor, errors.Wrap(err, "webdav List failed")
+	}
+	return entries, newCursor, nil
+}
+
+func (wp *WebDAVProvider) GetMetadata(ctx context.Context, p string) (*StorageEntry, error) {
+	entries, err := wp.propfind(ctx, p, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "webdav GetMetadata failed")
+	}
+	if len(entries) == 0 {
+		return nil, errors.Errorf("webdav GetMetadata failed: no properties for %s", p)
+	}
+	entry := entries[0]
+	if entry.ID == "" {
+		entry.ID = webDAVFileID(entry)
+	}
+	return entry, nil
+}
+
+type ocsShare struct {
+	ShareType int    `json:"share_type"`
+	URL       string `json:"url"`
+}
+
+type ocsResponse struct {
+	OCS struct {
+		Meta struct {
+			StatusCode int    `json:"statuscode"`
+			Message    string `json:"message"`
+		} `json:"meta"`
+		Data json.RawMessage `json:"data"`
+	} `json:"ocs"`
+}
+
+const ocsSharesPath = "/ocs/v2.php/apps/files_sharing/api/v1/shares"
+
+// ocsShareTypePublicLink is the share type of public links.
+const ocsShareTypePublicLink = 3
+
+// ocs calls the OCS share API and decodes the data of its response into v.
+func (wp *WebDAVProvider) ocs(ctx context.Context, method string, query url.Values, v interface{}) error {
+	u := strings.TrimSuffix(wp.opts.ShareURL, "/") + ocsSharesPath
+	var body io.Reader
+	if method == http.MethodGet {
+		u += "?" + query.Encode()
+	} else {
+		body = strings.NewReader(query.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("OCS-APIRequest", "true")
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := wp.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r ocsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	if r.OCS.Meta.StatusCode != http.StatusOK {
+		return errors.Errorf("ocs: %d: %s", r.OCS.Meta.StatusCode, r.OCS.Meta.Message)
+	}
+	return json.Unmarshal(r.OCS.Data, v)
+}
+
+// ShareLink returns the public link of the file, which is created through
+// the OCS share API unless it already exists.
+func (wp *WebDAVProvider) ShareLink(ctx context.Context, entry *StorageEntry) (string, error) {
+	link, err := wp.findShareLink(ctx, entry)
+	if err != nil || link != "" {
+		return link, errors.Wrap(err, "webdav ShareLink failed")
+	}
+
+	var share ocsShare
+	err = wp.ocs(ctx, http.MethodPost, url.Values{
+		"path":        {entry.Path},
+		"shareType":   {fmt.Sprint(ocsShareTypePublicLink)},
+		"permissions": {"1"},
+	}, &share)
+	if err != nil {
+		return "", errors.Wrap(err, "webdav ShareLink failed")
+	}
+	return share.URL, nil
+}
+
+// findShareLink returns the existing public link of entry, or "" if it has
+// none.
+func (wp *WebDAVProvider) findShareLink(ctx context.Context, entry *StorageEntry) (string, error) {
+	if wp.opts.ShareURL == "" {
+		return wp.fileURL(entry.Path), nil
+	}
+	var shares []ocsShare
+	err := wp.ocs(ctx, http.MethodGet, url.Values{
+		"path":     {entry.Path},
+		"reshares": {"false"},
+	}, &shares)
+	if err != nil {
+		return "", err
+	}
+	for _, share := range shares {
+		if share.ShareType == ocsShareTypePublicLink && share.URL != "" {
+			return share.URL, nil
+		}
+	}
+	return "", nil
+}
+
+// FindShareLinks returns the existing links of entries. Entries whose shares
+// cannot be listed are left out.
+func (wp *WebDAVProvider) FindShareLinks(ctx context.Context, entries []*StorageEntry) (map[string]string, error) {
+	links := make(map[string]string)
+	var errs error
+	for _, entry := range entries {
+		link, err := wp.findShareLink(ctx, entry)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		if link != "" {
+			links[entry.ID] = link
+		}
+	}
+	return links, errors.Wrap(errs, "webdav FindShareLinks failed")
+}
+
+func (wp *WebDAVProvider) Download(ctx context.Context, entry *StorageEntry) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wp.fileURL(entry.Path), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "webdav Download failed")
+	}
+	resp, err := wp.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "webdav Download failed")
+	}
+	return resp.Body, nil
+}
+
+// mkcol creates the parent folders of p. Existing folders are ignored.
+func (wp *WebDAVProvider) mkcol(ctx context.Context, p string) error {
+	dir := path.Dir(path.Clean("/" + p))
+	if dir == "/" {
+		return nil
+	}
+	if err := wp.mkcol(ctx, dir); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "MKCOL", wp.fileURL(dir), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := wp.do(req)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.status == http.StatusMethodNotAllowed {
+		// The folder exists.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (wp *WebDAVProvider) Upload(ctx context.Context, p string, content io.Reader) (*StorageEntry, error) {
+	if err := wp.mkcol(ctx, p); err != nil {
+		return nil, errors.Wrap(err, "webdav Upload failed")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, wp.fileURL(p), content)
+	if err != nil {
+		return nil, errors.Wrap(err, "webdav Upload failed")
+	}
+	resp, err := wp.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "webdav Upload failed")
+	}
+	resp.Body.Close()
+	return wp.GetMetadata(ctx, p)
+}
+
+// do sends an authenticated request and fails on non-2xx responses.
+func (wp *WebDAVProvider) do(req *http.Request) (*http.Response, error) {
+	if wp.opts.Username != "" {
+		req.SetBasicAuth(wp.opts.Username, wp.opts.Password)
+	}
+	resp, err := wp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, newStatusError(resp.StatusCode, "webdav: %s %s: unexpected status %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
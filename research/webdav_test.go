@@ -0,0 +1,197 @@
+package research
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// testDAVServer is a WebDAV server that records the folders it lists.
+type testDAVServer struct {
+	*httptest.Server
+	fs webdav.FileSystem
+
+	lock      sync.Mutex
+	propfinds []string
+}
+
+func newTestDAVServer(t *testing.T) *testDAVServer {
+	ds := &testDAVServer{fs: webdav.NewMemFS()}
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: ds.fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	ds.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PROPFIND" {
+			ds.lock.Lock()
+			ds.propfinds = append(ds.propfinds, strings.TrimPrefix(r.URL.Path, "/dav"))
+			ds.lock.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ds.Close)
+	return ds
+}
+
+func (ds *testDAVServer) writeFile(t *testing.T, p string, content string) {
+	t.Helper()
+	ctx := context.Background()
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		dir := "/" + strings.Join(parts[:i], "/")
+		if err := ds.fs.Mkdir(ctx, dir, 0755); err != nil && !os.IsExist(err) {
+			t.Fatal(err)
+		}
+	}
+	f, err := ds.fs.OpenFile(ctx, p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setProp sets a property of p as the server would report it, e.g. the ETag
+// of a folder or the file ID of Nextcloud.
+func (ds *testDAVServer) setProp(t *testing.T, p string, name xml.Name, value string) {
+	t.Helper()
+	f, err := ds.fs.OpenFile(context.Background(), p, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.(webdav.DeadPropsHolder).Patch([]webdav.Proppatch{{
+		Props: []webdav.Property{{XMLName: name, InnerXML: []byte(value)}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (ds *testDAVServer) setFolderETag(t *testing.T, p string, etag string) {
+	ds.setProp(t, p, xml.Name{Space: "DAV:", Local: "getetag"}, `"`+etag+`"`)
+}
+
+func (ds *testDAVServer) takePropfinds() []string {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	propfinds := ds.propfinds
+	ds.propfinds = nil
+	sort.Strings(propfinds)
+	return propfinds
+}
+
+func entryKinds(entries []*StorageEntry) map[string]EntryKind {
+	kinds := make(map[string]EntryKind)
+	for _, entry := range entries {
+		kinds[entry.Path] = entry.Kind
+	}
+	return kinds
+}
+
+func TestWebDAVList(t *testing.T) {
+	ds := newTestDAVServer(t)
+	ds.writeFile(t, "/papers/a.pdf", "a")
+	ds.writeFile(t, "/papers/sub/b.pdf", "b")
+	ds.writeFile(t, "/papers/sub/deep/c.pdf", "c")
+	ds.writeFile(t, "/papers/other/d.pdf", "d")
+	ds.writeFile(t, "/papers/.hidden.pdf", "hidden")
+	ds.setProp(t, "/papers/a.pdf", xml.Name{Space: "http://owncloud.org/ns", Local: "fileid"}, "42")
+	ds.setFolderETag(t, "/papers/sub", "sub-1")
+	ds.setFolderETag(t, "/papers/sub/deep", "deep-1")
+	ds.setFolderETag(t, "/papers/other", "other-1")
+
+	wp, err := NewWebDAVProvider(WebDAVOptions{URL: ds.URL + "/dav/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	entries, cursor, err := wp.List(ctx, "/papers", "", true)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	kinds := entryKinds(entries)
+	if len(kinds) != 4 || kinds["/papers/a.pdf"] != EntryFile || kinds["/papers/sub/deep/c.pdf"] != EntryFile {
+		t.Errorf("first List = %v, want the four files", kinds)
+	}
+	for _, entry := range entries {
+		if entry.Path == "/papers/a.pdf" && entry.ID != "42" {
+			t.Errorf("ID of %s = %q, want the oc:fileid 42", entry.Path, entry.ID)
+		}
+		if entry.ID == "" || strings.Contains(entry.ID, ":") {
+			t.Errorf("ID of %s = %q, want a bare ID", entry.Path, entry.ID)
+		}
+	}
+	ds.takePropfinds()
+
+	entries, cursor, err = wp.List(ctx, "/papers", cursor, true)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("unchanged List = %v, %v, want no entries", entryKinds(entries), err)
+	}
+	if got := ds.takePropfinds(); len(got) != 1 || got[0] != "/papers" {
+		t.Errorf("unchanged List requested %v, want only /papers", got)
+	}
+
+	// The server changes the ETags of the folders up to the changed file.
+	ds.writeFile(t, "/papers/sub/deep/c.pdf", "changed")
+	ds.setFolderETag(t, "/papers/sub", "sub-2")
+	ds.setFolderETag(t, "/papers/sub/deep", "deep-2")
+	entries, cursor, err = wp.List(ctx, "/papers", cursor, true)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if kinds := entryKinds(entries); len(kinds) != 1 || kinds["/papers/sub/deep/c.pdf"] != EntryFile {
+		t.Errorf("List after a change = %v, want /papers/sub/deep/c.pdf", kinds)
+	}
+	want := []string{"/papers", "/papers/sub", "/papers/sub/deep"}
+	if got := ds.takePropfinds(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("List after a change requested %v, want %v", got, want)
+	}
+
+	// Files in skipped folders are still known, so their deletion is found.
+	if err := ds.fs.RemoveAll(ctx, "/papers/other"); err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err = wp.List(ctx, "/papers", cursor, true)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if kinds := entryKinds(entries); len(kinds) != 1 || kinds["/papers/other/d.pdf"] != EntryDeleted {
+		t.Errorf("List after a deletion = %v, want /papers/other/d.pdf deleted", kinds)
+	}
+}
+
+func TestWebDAVUpload(t *testing.T) {
+	ds := newTestDAVServer(t)
+	wp, err := NewWebDAVProvider(WebDAVOptions{URL: ds.URL + "/dav"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, p := range []string{"/archive/2021/a.pdf", "/archive/2021/b.pdf"} {
+		entry, err := wp.Upload(ctx, p, strings.NewReader("content of "+p))
+		if err != nil {
+			t.Fatalf("Upload of %s failed: %v", p, err)
+		}
+		if entry.Path != p || entry.Kind != EntryFile || entry.Size != int64(len("content of "+p)) || entry.ID == "" {
+			t.Errorf("Upload of %s = %+v", p, entry)
+		}
+	}
+	info, err := ds.fs.Stat(ctx, "/archive/2021")
+	if err != nil || !info.IsDir() {
+		t.Errorf("parent folder has not been created: %v", err)
+	}
+}